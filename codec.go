@@ -0,0 +1,143 @@
+package rds
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Codec encodes and decodes values stored in Redis: the whole item's payload with BlobLayout,
+// and values that can't be stored as plain strings (maps, slices, etc.) with FieldsLayout.
+type Codec interface {
+	// Name identifies the codec. With FieldsLayout it's stored as a type of the encoded values,
+	// so that they can be decoded even after the Handler's codec has been changed.
+	Name() string
+	// Marshal encodes a value.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into a value pointed by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// GobCodec encodes values with encoding/gob. Values are restored exactly as they were,
+	// but can't be read by anything but Go. It's used by default.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values as JSON. Values can be read from redis-cli or any other language.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes values with MessagePack. It's more compact than JSON and is still supported by most languages.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// codecs are the built-in codecs by their names.
+var codecs = map[string]Codec{
+	GobCodec.Name():     GobCodec,
+	JSONCodec.Name():    JSONCodec,
+	MsgpackCodec.Name(): MsgpackCodec,
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var box bytes.Buffer
+	if err := gob.NewEncoder(&box).Encode(v); err != nil {
+		return nil, err
+	}
+	return box.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// restorePayloadTypes converts payload values decoded by a codec to the types of the schema fields.
+// Codecs other than gob lose Go types: JSON has only float64 numbers and stores time as a string,
+// MessagePack decodes integers into the smallest suitable type, etc.
+func restorePayloadTypes(s *schema.Schema, payload map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	for name, value := range payload {
+		if f, ok := s.Fields[name]; ok {
+			payload[name] = restoreValueType(f, value)
+		}
+	}
+}
+
+// restoreValueType converts a value decoded by a codec to the type of the schema field.
+// Values that can't be converted are returned as is.
+func restoreValueType(f schema.Field, value interface{}) interface{} {
+	if f.Schema != nil {
+		if v, ok := value.(map[string]interface{}); ok {
+			restorePayloadTypes(f.Schema, v)
+		}
+		return value
+	}
+
+	switch validator := f.Validator.(type) {
+	case *schema.Time:
+		if t, ok := toTime(value); ok {
+			return t
+		}
+	case *schema.Integer:
+		if f := toFloat64(value); !math.IsNaN(f) {
+			return toInt(value)
+		}
+	case *schema.Float:
+		if f := toFloat64(value); !math.IsNaN(f) {
+			return f
+		}
+	case *schema.Object:
+		if v, ok := value.(map[string]interface{}); ok {
+			restorePayloadTypes(validator.Schema, v)
+		}
+	case *schema.Dict:
+		if v, ok := value.(map[string]interface{}); ok {
+			for k, item := range v {
+				v[k] = restoreValueType(validator.Values, item)
+			}
+		}
+	case *schema.Array:
+		if v, ok := value.([]interface{}); ok {
+			for i, item := range v {
+				v[i] = restoreValueType(validator.Values, item)
+			}
+		}
+	}
+	return value
+}
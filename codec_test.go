@@ -0,0 +1,95 @@
+package rds
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+var codecTestSchema = schema.Schema{
+	Fields: schema.Fields{
+		"name":   {Validator: &schema.String{}},
+		"age":    {Validator: &schema.Integer{}},
+		"height": {Validator: &schema.Float{}},
+		"birth":  {Validator: &schema.Time{}},
+		"male":   {Validator: &schema.Bool{}},
+		"meta": {
+			Schema: &schema.Schema{
+				Fields: schema.Fields{
+					"title":   {Validator: &schema.String{}},
+					"created": {Validator: &schema.Time{}},
+				},
+			},
+		},
+		"scores": {
+			Validator: &schema.Array{
+				Values: schema.Field{Validator: &schema.Integer{}},
+			},
+		},
+	},
+}
+
+func TestCodecs(t *testing.T) {
+	birth := time.Date(1985, 10, 26, 1, 21, 0, 123456789, time.UTC)
+	for _, codec := range []Codec{GobCodec, JSONCodec, MsgpackCodec} {
+		msg := fmt.Sprintf("Codec %s", codec.Name())
+		payload := map[string]interface{}{
+			"name":   "Bob",
+			"age":    35,
+			"height": 185.5,
+			"birth":  birth,
+			"male":   true,
+			"meta": map[string]interface{}{
+				"title":   "foo",
+				"created": birth,
+			},
+			"scores": []interface{}{1, 500, 70000},
+		}
+		data, err := codec.Marshal(payload)
+		assert.NoError(t, err, msg)
+
+		result := make(map[string]interface{})
+		assert.NoError(t, codec.Unmarshal(data, &result), msg)
+		restorePayloadTypes(&codecTestSchema, result)
+
+		assert.Equal(t, "Bob", result["name"], msg)
+		assert.Equal(t, 35, result["age"], msg)
+		assert.Equal(t, 185.5, result["height"], msg)
+		assert.Equal(t, true, result["male"], msg)
+		assert.True(t, birth.Equal(result["birth"].(time.Time)), msg)
+		meta := result["meta"].(map[string]interface{})
+		assert.Equal(t, "foo", meta["title"], msg)
+		assert.True(t, birth.Equal(meta["created"].(time.Time)), msg)
+		assert.Equal(t, []interface{}{1, 500, 70000}, result["scores"], msg)
+	}
+}
+
+func TestCodecNames(t *testing.T) {
+	assert.Equal(t, "gob", GobCodec.Name())
+	assert.Equal(t, "json", JSONCodec.Name())
+	assert.Equal(t, "msgpack", MsgpackCodec.Name())
+}
+
+func TestRestoreValueType(t *testing.T) {
+	cases := []struct {
+		field schema.Field
+		value interface{}
+		want  interface{}
+	}{
+		{schema.Field{Validator: &schema.Integer{}}, float64(5), 5},
+		{schema.Field{Validator: &schema.Integer{}}, int8(5), 5},
+		{schema.Field{Validator: &schema.Integer{}}, uint16(500), 500},
+		{schema.Field{Validator: &schema.Integer{}}, "5", "5"},
+		{schema.Field{Validator: &schema.Float{}}, int64(5), 5.0},
+		{schema.Field{Validator: &schema.Float{}}, float32(1.5), 1.5},
+		{schema.Field{Validator: &schema.Time{}}, "not a time", "not a time"},
+		{schema.Field{Validator: &schema.String{}}, "foo", "foo"},
+		{schema.Field{}, float64(5), float64(5)},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, restoreValueType(tc.field, tc.value), fmt.Sprintf("Test case #%d", i))
+	}
+}
@@ -51,7 +51,9 @@ var (
 				Schema: &schema.Schema{
 					Fields: schema.Fields{
 						"title": {
-							Required: true,
+							Required:   true,
+							Filterable: true,
+							Sortable:   true,
 							Validator: &schema.String{
 								MaxLen: 150,
 							},
@@ -78,13 +80,22 @@ func Example() {
 		panic(err)
 	}
 
+	usersHandler, err := rds.NewHandler(client, "users", user)
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %s", err)
+	}
+	postsHandler, err := rds.NewHandler(client, "posts", post, rds.WithCodec(rds.JSONCodec))
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %s", err)
+	}
+
 	index := resource.NewIndex()
 
-	users := index.Bind("users", user, rds.NewHandler(client, "users", user), resource.Conf{
+	users := index.Bind("users", user, usersHandler, resource.Conf{
 		AllowedModes: resource.ReadWrite,
 	})
 
-	users.Bind("posts", "user", post, rds.NewHandler(client, "posts", post), resource.Conf{
+	users.Bind("posts", "user", post, postsHandler, resource.Conf{
 		AllowedModes: resource.ReadWrite,
 	})
 
@@ -2,34 +2,57 @@ package rds
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"time"
 	"fmt"
-	"bytes"
+	"strings"
 
-	"github.com/go-redis/redis"
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 )
 
 // Register all possible types to be gob-ed
 func init() {
 	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
 }
 
 type ItemManager struct {
 	EntityName string
+	// Namespace all keys of the entity are stored under, e.g. 'billing' for 'billing:users:1234'.
+	// Allows several applications to share a Redis database. No namespace is used if empty.
+	Namespace string
+	// Tenant all keys of the entity are scoped to, e.g. 'acme' for 'acme:users:1234'. No tenant is used if empty.
+	// It's set for every request by a Handler with a tenant extractor.
+	Tenant string
+	// HashTags makes all keys of the entity start with the hash tag of its name (e.g. '{users}:1234'),
+	// so that they are stored in the same slot of Redis Cluster and can be used together in scripts.
+	HashTags bool
+	// KeyEncoding defines how keys of items and their indices are built.
+	KeyEncoding KeyEncoding
+	// Layout defines how items are stored in Redis hashes.
+	Layout Layout
+	// Codec encodes payloads (or their non-scalar values with FieldsLayout). GobCodec is used if not set.
+	Codec Codec
+	// Schema of a resource. Is used to restore types of values decoded by Codec.
+	Schema *schema.Schema
 	// TODO - not needed with json
 	FieldNames []string
+	// top-level fields of a resource schema. Are stored as separate hash fields with FieldsLayout.
+	Fields []string
 	// needed to determine what secondary indices we are going to create to allow filtering (see predicate.go).
+	// Nested fields are denoted by their dotted paths, e.g. 'meta.title'. So are Numeric and Sortable ones.
 	Filterable []string
 	// needed for SORT type determination.
 	Numeric    []string
 	Sortable   []string
+	// fields of arrays of scalars. Their elements are indexed in sets, so numbers are matched only by equality.
+	Arrays []string
 } 
 
 // NewRedisItem converts a resource.Item into a suitable for go-redis HMSet [key, value] pair
-func (im *ItemManager) NewRedisItem(i *resource.Item) (string, map[string]interface{}) {
-	var box bytes.Buffer
-	enc := gob.NewEncoder(&box)
+func (im *ItemManager) NewRedisItem(i *resource.Item) (string, map[string]interface{}, error) {
 	value := make(map[string]interface{})
 
 	// Add those fields because we don't want to store them separately,
@@ -44,131 +67,299 @@ func (im *ItemManager) NewRedisItem(i *resource.Item) (string, map[string]interf
 	}
 
 	value[ETagField] = i.ETag
-	// TODO deal with _
-	_ = enc.Encode(payload)
-	value[payloadField] = box.Bytes()
 
-	return im.RedisItemKey(i), value
+	if im.Layout == BlobLayout {
+		encoded, err := im.codec().Marshal(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		value[payloadField] = encoded
+		return im.RedisItemKey(i), value, nil
+	}
+
+	types := make(map[string]string, len(payload))
+	for k, v := range payload {
+		t, encoded, err := encodeFieldValue(im.codec(), v)
+		if err != nil {
+			return "", nil, fmt.Errorf("can't encode field %q: %v", k, err)
+		}
+		types[k] = t
+		value[k] = encoded
+	}
+	encodedTypes, err := json.Marshal(types)
+	if err != nil {
+		return "", nil, err
+	}
+	value[typesField] = string(encodedTypes)
+
+	// Nested fields are encoded along with their objects, so values of the sortable ones are copied
+	// into hash fields of their own, e.g. 'meta.title', for SORT ... BY and HMGET to get them.
+	for _, field := range im.Sortable {
+		if !strings.Contains(field, ".") {
+			continue
+		}
+		if v, ok := payloadValue(payload, field); ok && isScalar(v) {
+			_, encoded, err := encodeFieldValue(im.codec(), v)
+			if err != nil {
+				return "", nil, fmt.Errorf("can't encode field %q: %v", field, err)
+			}
+			value[field] = encoded
+		}
+	}
+
+	return im.RedisItemKey(i), value, nil
+}
+
+// CorruptedItemError is returned when an item stored in Redis can't be decoded:
+// it was written by a foreign application, with an unknown codec, damaged manually, etc.
+type CorruptedItemError struct {
+	// Key of the item's hash.
+	Key string
+	Err error
+}
+
+func (e *CorruptedItemError) Error() string {
+	return fmt.Sprintf("corrupted item %q: %v", e.Key, e.Err)
 }
 
-// NewItem converts a Redis item from DB into resource.Item
-func (im *ItemManager) NewItem(data []interface{}) *resource.Item {
+// NewItem converts a Redis item from DB into resource.Item.
+// Data contains values of FieldNames hash fields of the item stored under the key in the same order.
+// Returns CorruptedItemError if the item can't be decoded.
+func (im *ItemManager) NewItem(key string, data []interface{}) (*resource.Item, error) {
 	payload := make(map[string]interface{})
 	item := new(resource.Item)
+	raw := make(map[string]string)
 
+	corrupted := func(format string, a ...interface{}) (*resource.Item, error) {
+		return nil, &CorruptedItemError{Key: key, Err: fmt.Errorf(format, a...)}
+	}
+
+	if len(data) != len(im.FieldNames) {
+		return corrupted("got %d hash fields, expected %d", len(data), len(im.FieldNames))
+	}
 	for i, v := range im.FieldNames {
-		value := data[i].(string)
-		if v == payloadField {
-			dec := gob.NewDecoder(bytes.NewBufferString(value))
-			// TODO deal with _
-			_ = dec.Decode(&payload)
-			item.Payload = payload
-		} else if v == ETagField {
-			item.ETag = value
+		// Missing hash fields come as nil
+		if value, ok := data[i].(string); ok {
+			raw[v] = value
 		}
 	}
+	item.ETag = raw[ETagField]
+
+	if im.Layout == BlobLayout {
+		if err := im.codec().Unmarshal([]byte(raw[payloadField]), &payload); err != nil {
+			return corrupted("can't decode payload: %v", err)
+		}
+		restorePayloadTypes(im.Schema, payload)
+	} else {
+		types := make(map[string]string)
+		if err := json.Unmarshal([]byte(raw[typesField]), &types); err != nil {
+			return corrupted("can't decode types of fields: %v", err)
+		}
+		// Values that were encoded by a codec may need their types to be restored
+		encoded := make(map[string]interface{})
+		for field, t := range types {
+			if value, ok := raw[field]; ok {
+				v, err := decodeFieldValue(im.codec(), t, value)
+				if err != nil {
+					return corrupted("can't decode field %q: %v", field, err)
+				}
+				if isScalarType(t) {
+					payload[field] = v
+				} else {
+					encoded[field] = v
+				}
+			}
+		}
+		restorePayloadTypes(im.Schema, encoded)
+		for field, v := range encoded {
+			payload[field] = v
+		}
+	}
+	item.Payload = payload
+
 	item.ID = item.Payload["id"]
+	if item.ID == nil {
+		return corrupted("no id in payload")
+	}
+	// Codecs may lose time type. Restore it even if a schema has no 'updated' field.
 	// todo - may be not OK?
-	if val, ok := item.Payload["updated"].(time.Time); ok {
+	if val, ok := toTime(item.Payload["updated"]); ok {
+		item.Payload["updated"] = val
 		item.Updated = val
 	}
 
-	return item
+	return item, nil
 }
 
-// RedisItemKey returns a redis-compatible string key to denote a Hash key of an item. E.g. 'users:1234'.
+// codec returns the Codec payloads are encoded with.
+func (im *ItemManager) codec() Codec {
+	if im.Codec == nil {
+		return GobCodec
+	}
+	return im.Codec
+}
+
+// RedisItemKey returns a redis-compatible string key to denote a Hash key of an item. E.g. 'users:item:1234'.
 func (im *ItemManager) RedisItemKey(i *resource.Item) string {
-	return fmt.Sprintf("%s:%s", im.EntityName, i.ID)
+	return im.keys().item(i.ID)
+}
+
+// keys returns the keyspace of the items: all their keys start with the entity name prefixed by the tenant
+// and the namespace.
+func (im *ItemManager) keys() keyspace {
+	prefix := im.EntityName
+	if im.Tenant != "" {
+		tenant := im.Tenant
+		if im.KeyEncoding == EscapedKeys {
+			tenant = escapeKeyPart(tenant)
+		}
+		prefix = namespaced(tenant, prefix)
+	}
+	if im.Namespace != "" {
+		prefix = namespaced(im.Namespace, prefix)
+	}
+	if im.HashTags {
+		prefix = hashTag(prefix)
+	}
+	return keyspace{prefix: prefix, encoding: im.KeyEncoding, arrays: im.Arrays}
 }
 
 // IndexSetKeys returns a secondary index keys for a resource's filterable fields suited for SET.
 // Is used so that we can find them when needed.
-// Ex: for user A returns ["users:hair:brown", "users:city:NYC"]
-//     for user B returns ["users:hair:red", "users:city:Boston"]
+// Ex: for user A returns ["users:set:hair:brown", "users:set:city:NYC"]
+//     for user B returns ["users:set:hair:red", "users:set:city:Boston"]
 func (im *ItemManager) IndexSetKeys(i *resource.Item) []string {
 	var result []string
+	for _, s := range im.setIndices(i) {
+		result = append(result, s.key)
+	}
+	return result
+}
+
+// setIndex is a set index of a value of a field.
+type setIndex struct {
+	key string
+	// registry is the key of the registry of the field's set indices, empty with PlainKeys (see keyspace.registry).
+	registry string
+}
+
+// setIndices returns set indices of a resource's filterable fields along with their registries (see IndexSetKeys).
+func (im *ItemManager) setIndices(i *resource.Item) []setIndex {
+	ks := im.keys()
+	var result []setIndex
 	for _, field := range im.Filterable {
-		if value, ok := i.Payload[field]; ok && !isNumeric(value) {
-			result = append(result, sKey(im.EntityName, field, value))
+		value, ok := payloadValue(i.Payload, field)
+		if !ok {
+			continue
+		}
+		// Every element of an array is indexed separately. Elements that are objects are indexed by elemIndices.
+		// Numbers can't be indexed in a sorted set more than once per item, so numeric elements are indexed in sets too.
+		// Hence they are matched only by equality (see numeric).
+		if values, ok := value.([]interface{}); ok {
+			for _, v := range values {
+				if isScalar(v) {
+					result = append(result, setIndex{key: ks.set(field, v), registry: ks.registry(field)})
+				}
+			}
+			continue
+		}
+		// Objects are indexed by their nested fields
+		if isScalar(value) && !isNumeric(value) {
+			result = append(result, setIndex{key: ks.set(field, value), registry: ks.registry(field)})
 		}
 	}
 	// TODO - do we need etag? Isn't ID already in filterable?
-	result = append(result, sKey(im.EntityName, "id", i.ID))
+	result = append(result, setIndex{key: ks.set("id", i.ID), registry: ks.registry("id")})
 	return result
 }
 
-// IndexZSetKeys returns a secondary index keys for a resource's filterable fields suited for ZSET.
-// Is used so that we can find them when needed.
-// Ex: for user A returns {"users:age": 24, "users:salary": 75000}
-//     for user B returns {"users:age": 56, "users:salary": 125000}
-func (im *ItemManager) IndexZSetKeys(i *resource.Item) map[string]float64 {
-	// TODO: float for all?
-	result := make(map[string]float64)
+// ExistsSetKeys returns keys of the sets of items that have values of a resource's filterable fields.
+// Such sets are maintained only with EscapedKeys.
+// Ex: for user A returns ["users:exists:hair", "users:exists:city"]
+//     for user B returns ["users:exists:hair"]
+func (im *ItemManager) ExistsSetKeys(i *resource.Item) []string {
+	if im.KeyEncoding == PlainKeys {
+		return nil
+	}
+	var result []string
 	for _, field := range im.Filterable {
-		if value, ok := i.Payload[field]; ok && isNumeric(value) {
-			result[zKey(im.EntityName, field)] = valueToFloat(value)
+		if value, ok := payloadValue(i.Payload, field); ok && value != nil {
+			result = append(result, im.keys().exists(field))
 		}
 	}
-	// TODO - do we need etag? Isn't updated already in filterable?
-	result[zKey(im.EntityName, "updated")] = valueToFloat(i.Updated)
-
 	return result
 }
 
-// AddSecondaryIndices adds:
-// - new values to a secondary index for a given item.
-// - index names to a maintained auxiliary list of item's indices.
-// Action is appended to a Redis pipeline.
-func (im *ItemManager) AddSecondaryIndices(pipe redis.Pipeliner, item *resource.Item) {
-	var setIndexes, zSetIndexes []interface{}
-	itemID := im.RedisItemKey(item)
-	for _, v := range im.IndexSetKeys(item) {
-		pipe.SAdd(v, itemID)
-		setIndexes = append(setIndexes, v)
-	}
-	for k, v := range im.IndexZSetKeys(item) {
-		pipe.ZAdd(k, redis.Z{Member: itemID, Score: v})
-		zSetIndexes = append(zSetIndexes, k)
-	}
-	if len(setIndexes) > 0 {
-		pipe.SAdd(auxIndexListKey(itemID, false), setIndexes...)
-	}
-	if len(zSetIndexes) > 0 {
-		pipe.SAdd(auxIndexListKey(itemID, true), zSetIndexes...)
-	}
+// Kinds of indices of array elements.
+const (
+	elemSet  = "s"
+	elemZSet = "z"
+	// a set of all elements of an array
+	elemAll = "a"
+)
+
+// elemIndex is an index of an element of an array of objects.
+type elemIndex struct {
+	kind string
+	key  string
+	// registry is the key of the registry of a set index (see keyspace.registry).
+	registry string
+	// elem is a position of the element in the array.
+	elem  int
+	score float64
 }
 
-// DeleteSecondaryIndices removes:
-// - a secondary index for a given item.
-// - index names to a maintained auxiliary list of item's indices.
-// Action is appended to a Redis pipeline.
-func (im *ItemManager) DeleteSecondaryIndices(pipe redis.Pipeliner, item *resource.Item) {
-	var setIndexes, zSetIndexes []interface{}
-	itemID := im.RedisItemKey(item)
-	for _, v := range im.IndexSetKeys(item) {
-		pipe.SRem(v, itemID)
-		setIndexes = append(setIndexes, v)
-	}
-	for k := range im.IndexZSetKeys(item) {
-		pipe.ZRem(k, itemID)
-		zSetIndexes = append(zSetIndexes, k)
-	}
-	// TODO - shouldn't we delete the entire list?
-	if len(setIndexes) > 0 {
-		pipe.SRem(auxIndexListKey(itemID, false), setIndexes...)
-	}
-	if len(zSetIndexes) > 0 {
-		pipe.SRem(auxIndexListKey(itemID, true), zSetIndexes...)
+// elemIndices returns indices of elements of a resource's filterable arrays of objects.
+// Scalar fields of every element are indexed just like top-level fields, but in the keyspace of the array's elements.
+// Ex: for post A with comments [{author: Bob, likes: 2}] returns
+//     [{a posts:elems:comments 0}, {s posts:set:comments.author:Bob 0}, {z posts:zset:comments.likes 0 2}]
+func (im *ItemManager) elemIndices(i *resource.Item) []elemIndex {
+	var result []elemIndex
+	for _, field := range im.Filterable {
+		value, _ := payloadValue(i.Payload, field)
+		values, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		ks, ok := im.keys().elements(field)
+		if !ok {
+			return nil
+		}
+		for n, v := range values {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			result = append(result, elemIndex{kind: elemAll, key: ks.allIDs(), elem: n})
+			for _, f := range sortedFields(obj) {
+				value := obj[f]
+				switch {
+				case value == nil || !isScalar(value):
+				case isNumeric(value):
+					result = append(result, elemIndex{kind: elemZSet, key: ks.zset(f), elem: n, score: valueToFloat(value)})
+				default:
+					result = append(result, elemIndex{kind: elemSet, key: ks.set(f, value), registry: ks.registry(f), elem: n})
+				}
+			}
+		}
 	}
+	return result
 }
 
-// TODO - generalize to secondary idxs?
-// AddIDToAllIDsSet adds item's ID to a set of all stored IDs
-func (im *ItemManager) AddIDToAllIDsSet(pipe redis.Pipeliner, i *resource.Item) {
-	pipe.SAdd(sKeyIDsAll(im.EntityName), im.RedisItemKey(i))
-}
+// IndexZSetKeys returns a secondary index keys for a resource's filterable fields suited for ZSET.
+// Is used so that we can find them when needed.
+// Ex: for user A returns {"users:zset:age": 24, "users:zset:salary": 75000}
+//     for user B returns {"users:zset:age": 56, "users:zset:salary": 125000}
+func (im *ItemManager) IndexZSetKeys(i *resource.Item) map[string]float64 {
+	// TODO: float for all?
+	result := make(map[string]float64)
+	for _, field := range im.Filterable {
+		if value, ok := payloadValue(i.Payload, field); ok && isNumeric(value) {
+			result[im.keys().zset(field)] = valueToFloat(value)
+		}
+	}
+	// TODO - do we need etag? Isn't updated already in filterable?
+	result[im.keys().zset("updated")] = valueToFloat(i.Updated)
 
-// DeleteIDFromAllIDsSet removes item's ID from a set of all stored IDs
-func (im *ItemManager) DeleteIDFromAllIDsSet(pipe redis.Pipeliner, i *resource.Item) {
-	pipe.SRem(sKeyIDsAll(im.EntityName), im.RedisItemKey(i))
+	return result
 }
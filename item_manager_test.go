@@ -12,35 +12,135 @@ import (
 
 func TestRedisItemKey(t *testing.T) {
 	cases := []struct {
-		entity string
-		item *resource.Item
-		want string
+		entity   string
+		encoding rds.KeyEncoding
+		item     *resource.Item
+		want     string
 	}{
 		{
 			"users",
+			rds.PlainKeys,
 			&resource.Item{ID: "123"},
 			"users:123",
 		},
 		{
 			"users:foo:bar",
+			rds.PlainKeys,
 			&resource.Item{ID: "123"},
 			"users:foo:bar:123",
 		},
 		{
 			"users:",
+			rds.PlainKeys,
 			&resource.Item{ID: ""},
 			"users::",
 		},
 		{
 			"",
+			rds.PlainKeys,
 			&resource.Item{ID: ""},
 			":",
 		},
+		{
+			"users",
+			rds.EscapedKeys,
+			&resource.Item{ID: "123"},
+			"users:item:123",
+		},
+		{
+			"users",
+			rds.EscapedKeys,
+			&resource.Item{ID: "foo:bar*"},
+			"users:item:foo%3Abar%2A",
+		},
+		{
+			"users",
+			rds.EscapedKeys,
+			&resource.Item{ID: 42},
+			"users:item:42",
+		},
 	}
 	for i, tc := range cases {
 		manager := &rds.ItemManager{
-			EntityName: tc.entity,
+			EntityName:  tc.entity,
+			KeyEncoding: tc.encoding,
 		}
 		assert.Equal(t, tc.want, manager.RedisItemKey(tc.item), fmt.Sprintf("Test case #%d", i))
 	}
 }
+
+func TestNewRedisItemAndBack(t *testing.T) {
+	cases := []struct {
+		layout     rds.Layout
+		fieldNames []string
+	}{
+		{rds.FieldsLayout, []string{"_etag", "_types", "age", "id", "name", "updated"}},
+		{rds.BlobLayout, []string{"_etag", "payload"}},
+	}
+	for _, tc := range cases {
+		manager := &rds.ItemManager{
+			EntityName: "users",
+			Layout:     tc.layout,
+			FieldNames: tc.fieldNames,
+		}
+		item := &resource.Item{
+			ID:   "123",
+			ETag: "asdf",
+			Payload: map[string]interface{}{
+				"age":  35,
+				"name": "Bob",
+			},
+		}
+		key, value, err := manager.NewRedisItem(item)
+		assert.NoError(t, err)
+		assert.Equal(t, "users:item:123", key)
+		assert.Equal(t, "asdf", value["_etag"])
+
+		// emulate values as they come from Redis
+		var data []interface{}
+		for _, f := range manager.FieldNames {
+			switch v := value[f].(type) {
+			case nil:
+				data = append(data, nil)
+			case []byte:
+				data = append(data, string(v))
+			default:
+				data = append(data, v)
+			}
+		}
+		result, err := manager.NewItem(key, data)
+		assert.NoError(t, err)
+		assert.Equal(t, "123", result.ID)
+		assert.Equal(t, "asdf", result.ETag)
+		assert.Equal(t, 35, result.Payload["age"])
+		assert.Equal(t, "Bob", result.Payload["name"])
+	}
+}
+
+func TestNewItem_Corrupted(t *testing.T) {
+	cases := []struct {
+		layout     rds.Layout
+		fieldNames []string
+		data       []interface{}
+	}{
+		{rds.BlobLayout, []string{"_etag", "payload"}, []interface{}{"asdf", "garbage"}},
+		{rds.BlobLayout, []string{"_etag", "payload"}, []interface{}{nil, nil}},
+		{rds.FieldsLayout, []string{"_etag", "_types", "id"}, []interface{}{"asdf", "garbage", "123"}},
+		{rds.FieldsLayout, []string{"_etag", "_types", "id"}, []interface{}{"asdf", `{"id":"int"}`, "abc"}},
+		{rds.FieldsLayout, []string{"_etag", "_types", "id"}, []interface{}{"asdf", `{"id":"foo"}`, "123"}},
+		{rds.FieldsLayout, []string{"_etag", "_types", "id"}, []interface{}{"asdf", `{}`, nil}},
+		{rds.FieldsLayout, []string{"_etag", "_types", "id"}, []interface{}{"asdf"}},
+	}
+	for i, tc := range cases {
+		manager := &rds.ItemManager{
+			EntityName: "users",
+			Layout:     tc.layout,
+			FieldNames: tc.fieldNames,
+		}
+		result, err := manager.NewItem("users:123", tc.data)
+		assert.Nil(t, result, fmt.Sprintf("Test case #%d", i))
+		if assert.IsType(t, &rds.CorruptedItemError{}, err, fmt.Sprintf("Test case #%d", i)) {
+			assert.Equal(t, "users:123", err.(*rds.CorruptedItemError).Key)
+		}
+	}
+}
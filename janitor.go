@@ -0,0 +1,105 @@
+package rds
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// tempKeyTTL is the expiry temporary keys of queries are created with.
+// Queries delete them when they complete, so it matters only for the queries that fail midway.
+// Redis doesn't expire keys while a script is running, so it can't be shorter than a query.
+const tempKeyTTL = time.Minute
+
+// scanCount is a hint of how many keys a single SCAN call should look through.
+const scanCount = 1000
+
+// legacyTmpPattern matches temporary keys of queries created by the earlier versions.
+// They had no prefix of an entity, e.g. 'tmp_5577006791947779410_1557312323423'.
+const legacyTmpPattern = "tmp_*"
+
+// legacyTmpKeyRegexp matches exactly the keys created by the earlier versions among the ones matching legacyTmpPattern.
+var legacyTmpKeyRegexp = regexp.MustCompile(`^tmp_\d+_\d+$`)
+
+// DeleteTemporaryKeys finds and deletes temporary keys of queries left behind by the earlier versions
+// or by queries that failed midway before their keys expired.
+// Temporary keys exist only while a query's script is running, and scripts are atomic,
+// so all the found ones are orphaned. Keys are looked for with SCAN on every node of the client, Redis isn't blocked.
+// With a tenant extractor only the keys of the context's tenant are deleted. Keys of the earlier versions
+// have no prefix, so it's unknown what entity and tenant they belong to: they are deleted by any handler.
+// Returns the number of deleted keys.
+func (h *Handler) DeleteTemporaryKeys(ctx context.Context) (int, error) {
+	var mu sync.Mutex
+	deleted := 0
+	err := handleWithContext(ctx, func() error {
+		im, err := h.scopedItemManager(ctx)
+		if err != nil {
+			return err
+		}
+		ks := im.keys()
+		// The pattern may match keys of items and their auxiliary lists with PlainKeys, e.g. 'users:tmp_x'
+		tmpKeyRegexp := regexp.MustCompile(`^` + regexp.QuoteMeta(ks.prefix) + `:tmp_\d+_\d+$`)
+
+		return forEachNode(h.client, func(c redis.Cmdable) error {
+			n, err := deleteKeys(ctx, c, ks.tmpPattern(), tmpKeyRegexp)
+			if err != nil {
+				return err
+			}
+			legacy, err := deleteKeys(ctx, c, legacyTmpPattern, legacyTmpKeyRegexp)
+			mu.Lock()
+			deleted += n + legacy
+			mu.Unlock()
+			return err
+		})
+	})
+	return deleted, err
+}
+
+// deleteKeys deletes sets and zsets matching a pattern and a regexp with SCAN on a single node.
+// Returns the number of deleted keys.
+func deleteKeys(ctx context.Context, c redis.Cmdable, pattern string, re *regexp.Regexp) (int, error) {
+	deleted := 0
+	iter := c.Scan(0, pattern, scanCount).Iterator()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		key := iter.Val()
+		if !re.MatchString(key) {
+			continue
+		}
+		// Items are hashes, temporary keys are sets or zsets
+		kind, err := c.Type(key).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if kind != "set" && kind != "zset" {
+			continue
+		}
+		n, err := c.Del(key).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int(n)
+	}
+	return deleted, iter.Err()
+}
+
+// forEachNode calls fn for every master node of Redis Cluster or every shard of redis.Ring concurrently,
+// or just for the client itself if it's connected to a single server.
+func forEachNode(c redis.Cmdable, fn func(c redis.Cmdable) error) error {
+	switch t := c.(type) {
+	case *redis.ClusterClient:
+		return t.ForEachMaster(func(c *redis.Client) error {
+			return fn(c)
+		})
+	case *redis.Ring:
+		return t.ForEachShard(func(c *redis.Client) error {
+			return fn(c)
+		})
+	}
+	return fn(c)
+}
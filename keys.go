@@ -2,15 +2,232 @@ package rds
 
 import (
 	"fmt"
+	"strings"
 )
 
 const (
 	auxIndexListSortedSuffix = "secondary_idx_zset_list"
 	auxIndexListNonSortedSuffix = "secondary_idx_set_list"
+	auxIndexListElemSuffix = "secondary_idx_elem_list"
 	// TODO - can we use something already existing?
 	allIDsSuffix = "all_ids"
+	quarantineSuffix = "quarantine"
+	keysVersionSuffix = "keys_version"
+	// Kinds of keys with EscapedKeys.
+	itemKind = "item"
+	setKind = "set"
+	zSetKind = "zset"
+	idsKind = "ids"
+	existsKind = "exists"
+	elemsKind = "elems"
 )
 
+// KeyEncoding defines how keys of items and their indices are built.
+type KeyEncoding int
+
+const (
+	// EscapedKeys puts the kind of a key after the entity name and escapes IDs, field names and values,
+	// so that keys of different kinds and fields never collide and can be safely matched by patterns.
+	// Ex: users:item:1234, users:set:city:New%3AYork, users:zset:age, users:ids
+	EscapedKeys KeyEncoding = iota
+	// PlainKeys joins the entity name, IDs, field names and values with ':' as they are.
+	// This is how keys were built by the earlier versions, so use it to work with the existing data
+	// or migrate it with Handler.MigrateKeys.
+	// Ex: users:1234, users:city:New York, users:age, users:all_ids
+	PlainKeys
+)
+
+// version returns the version of the keys layout. It's stored in the keys version marker of an entity.
+func (e KeyEncoding) version() int {
+	if e == PlainKeys {
+		return 1
+	}
+	return 2
+}
+
+// keyPartEscaper escapes characters that separate parts of keys, are special in key patterns or hash tags.
+var keyPartEscaper = strings.NewReplacer(
+	"%", "%25",
+	":", "%3A",
+	"*", "%2A",
+	"?", "%3F",
+	"[", "%5B",
+	"]", "%5D",
+	"\\", "%5C",
+	"{", "%7B",
+	"}", "%7D",
+)
+
+// escapeKeyPart escapes a part of a key, so that it contains no separators and pattern characters.
+// Ex: New:York* -> New%3AYork%2A
+func escapeKeyPart(part interface{}) string {
+	return keyPartEscaper.Replace(fmt.Sprint(part))
+}
+
+// keyPartUnescaper restores parts of keys escaped by keyPartEscaper.
+var keyPartUnescaper = strings.NewReplacer(
+	"%25", "%",
+	"%3A", ":",
+	"%2A", "*",
+	"%3F", "?",
+	"%5B", "[",
+	"%5D", "]",
+	"%5C", "\\",
+	"%7B", "{",
+	"%7D", "}",
+)
+
+// unescapeKeyPart restores a part of a key escaped by escapeKeyPart.
+// Ex: New%3AYork%2A -> New:York*
+func unescapeKeyPart(part string) string {
+	return keyPartUnescaper.Replace(part)
+}
+
+// patternEscaper escapes characters that are special in key patterns, so that they match themselves.
+var patternEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"?", `\?`,
+	"[", `\[`,
+	"]", `\]`,
+)
+
+// keyspace builds all keys of an entity.
+type keyspace struct {
+	// prefix all the keys start with: the entity name possibly prefixed by a namespace and a tenant and hash-tagged.
+	prefix   string
+	encoding KeyEncoding
+	// array is a field of the array whose elements are indexed by the keys, if any (see elements).
+	array string
+	// arrays are fields of arrays of scalars. Their elements are indexed in sets by their values, even numeric ones.
+	arrays []string
+}
+
+// isArray tells whether a field is an array of scalars.
+func (ks keyspace) isArray(field string) bool {
+	return inSlice(field, ks.arrays)
+}
+
+// elements returns a keyspace of indices of elements of an array of objects.
+// Their members are the keys of items followed by indices of the elements, e.g. 'users:item:1:0'.
+// Fields of elements are prefixed with the array's field, e.g. 'users:set:comments.author:Bob'.
+// Indices of elements are maintained only with EscapedKeys and only for top-level arrays.
+func (ks keyspace) elements(field string) (keyspace, bool) {
+	if ks.encoding == PlainKeys || ks.array != "" {
+		return keyspace{}, false
+	}
+	return keyspace{prefix: ks.prefix, encoding: ks.encoding, array: ks.path(field)}, true
+}
+
+// path returns a path of a field, i.e. the field prefixed with the array's field in a keyspace of elements.
+func (ks keyspace) path(field string) string {
+	if ks.array == "" {
+		return field
+	}
+	return ks.array + "." + field
+}
+
+// item returns a key of an item's hash.
+func (ks keyspace) item(id interface{}) string {
+	if ks.encoding == PlainKeys {
+		return fmt.Sprintf("%s:%v", ks.prefix, id)
+	}
+	return fmt.Sprintf("%s:%s:%s", ks.prefix, itemKind, escapeKeyPart(id))
+}
+
+// set returns a key of a set index of a field's value.
+func (ks keyspace) set(field string, value interface{}) string {
+	if ks.encoding == PlainKeys {
+		return sKey(ks.prefix, field, value)
+	}
+	return sKey(namespaced(ks.prefix, setKind), escapeKeyPart(ks.path(field)), escapeKeyPart(value))
+}
+
+// registry returns a key of a set of keys of all set indices of a field, i.e. of all the field's values.
+// Registries are maintained only with EscapedKeys: the registry of a set index is the same key without the value.
+// Returns an empty string with PlainKeys.
+// Ex: users:set:city
+func (ks keyspace) registry(field string) string {
+	if ks.encoding == PlainKeys {
+		return ""
+	}
+	return zKey(namespaced(ks.prefix, setKind), escapeKeyPart(ks.path(field)))
+}
+
+// registered returns a prefix of keys of the set indices registered in registries, i.e. of all set indices
+// with EscapedKeys. Returns an empty string with PlainKeys.
+// Ex: users:set:
+func (ks keyspace) registered() string {
+	if ks.encoding == PlainKeys {
+		return ""
+	}
+	return namespaced(ks.prefix, setKind) + ":"
+}
+
+// exists returns a key of a set of items that have a value of a field.
+// Such sets are maintained only with EscapedKeys for top-level fields, returns an empty string otherwise.
+// Ex: users:exists:city
+func (ks keyspace) exists(field string) string {
+	if ks.encoding == PlainKeys || ks.array != "" {
+		return ""
+	}
+	return zKey(namespaced(ks.prefix, existsKind), escapeKeyPart(field))
+}
+
+// zset returns a key of a zset index of a field.
+func (ks keyspace) zset(field string) string {
+	if ks.encoding == PlainKeys {
+		return zKey(ks.prefix, field)
+	}
+	return zKey(namespaced(ks.prefix, zSetKind), escapeKeyPart(ks.path(field)))
+}
+
+// allIDs returns a key of a set of all items keys, or of all elements in a keyspace of elements.
+func (ks keyspace) allIDs() string {
+	if ks.encoding == PlainKeys {
+		return sKeyIDsAll(ks.prefix)
+	}
+	if ks.array != "" {
+		return zKey(namespaced(ks.prefix, elemsKind), escapeKeyPart(ks.array))
+	}
+	return namespaced(ks.prefix, idsKind)
+}
+
+// quarantine returns a key of a set of keys of corrupted items.
+func (ks keyspace) quarantine() string {
+	return sKeyQuarantine(ks.prefix)
+}
+
+// tmp returns a new key for a temporary set of a query.
+func (ks keyspace) tmp() string {
+	return tmpKey(ks.prefix)
+}
+
+// tmpPattern returns a pattern matching all temporary keys created by tmp.
+func (ks keyspace) tmpPattern() string {
+	return patternEscaper.Replace(ks.prefix) + ":tmp_*"
+}
+
+// keysVersion returns a key of the keys version marker. It's written only with EscapedKeys:
+// with PlainKeys it's the key of the item with 'keys_version' ID.
+// Ex: users:keys_version
+func (ks keyspace) keysVersion() string {
+	return fmt.Sprintf("%s:%s", ks.prefix, keysVersionSuffix)
+}
+
+// namespaced prefixes an entity name with a namespace.
+// Ex: billing, users -> billing:users
+func namespaced(namespace, entity string) string {
+	return fmt.Sprintf("%s:%s", namespace, entity)
+}
+
+// hashTag wraps an entity name into a Redis Cluster hash tag: only the part inside braces is hashed,
+// so all keys starting with it are stored in the same slot.
+// Ex: users -> {users}
+func hashTag(entity string) string {
+	return fmt.Sprintf("{%s}", entity)
+}
+
 // Get key name for a Redis set.
 // Ex: users:hair-color:brown
 func sKey(entity, key string, value interface{}) string {
@@ -23,18 +240,30 @@ func zKey(entity, key string) string {
 	return fmt.Sprintf("%s:%s", entity, key)
 }
 
-// Get a search pattern for the last element of a compound key (for Redis set).
-// Ex: users:hair-color:* -> get all stored ages of users.
-func sKeyLastAll(entity, key string) string {
-	return fmt.Sprintf("%s:%s:*", entity, key)
-}
-
 // Get a key for Set of all entities IDs.
 // Ex: users:all_ids
 func sKeyIDsAll(entity string) string {
 	return fmt.Sprintf("%s:%s", entity, allIDsSuffix)
 }
 
+// Get a key for Set of keys of corrupted items that were skipped by Find.
+// Ex: users:quarantine
+func sKeyQuarantine(entity string) string {
+	return fmt.Sprintf("%s:%s", entity, quarantineSuffix)
+}
+
+// Get a key name for a temporary set created by a query.
+// Ex: users:tmp_5577006791947779410_1557312323423
+func tmpKey(entity string) string {
+	return fmt.Sprintf("%s:%s", entity, tmpVar())
+}
+
+// auxElemListKey returns a key of an auxiliary list of indices of an Item's array elements.
+// Ex: users:item:1:secondary_idx_elem_list
+func auxElemListKey(itemKey string) string {
+	return fmt.Sprintf("%s:%s", itemKey, auxIndexListElemSuffix)
+}
+
 // auxIndexListKey returns a redis-compatible string key to denote a name of an auxiliary indices list of an Item.
 func auxIndexListKey(itemID string, sorted bool) string {
 	suffix := auxIndexListNonSortedSuffix
@@ -7,6 +7,34 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestNamespaced(t *testing.T) {
+	cases := []struct {
+		namespace string
+		entity    string
+		want      string
+	}{
+		{"billing", "users", "billing:users"},
+		{"billing:eu", "users", "billing:eu:users"},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, namespaced(tc.namespace, tc.entity), fmt.Sprintf("Test case #%d", i))
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	cases := []struct {
+		entity string
+		want   string
+	}{
+		{"users", "{users}"},
+		{"users:students", "{users:students}"},
+		{"", "{}"},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, hashTag(tc.entity), fmt.Sprintf("Test case #%d", i))
+	}
+}
+
 func TestSKey(t *testing.T) {
 	cases := []struct {
 		entity string
@@ -41,37 +69,40 @@ func TestZKey(t *testing.T) {
 	}
 }
 
-func TestSKeyLastAll(t *testing.T) {
+func TestSKeyIDsAll(t *testing.T) {
 	cases := []struct {
 		entity string
-		key    string
 		want   string
 	}{
-		{"users", "bob", "users:bob:*"},
-		{"users", "bob", "users:bob:*"},
-		{"users:students", "bob", "users:students:bob:*"},
-		{"users_students", "bob", "users_students:bob:*"},
+		{"users", "users:all_ids"},
+		{"", ":all_ids"},
+		{"users:students", "users:students:all_ids"},
+		{"users_students", "users_students:all_ids"},
 	}
 	for i, tc := range cases {
-		assert.Equal(t, tc.want, sKeyLastAll(tc.entity, tc.key), fmt.Sprintf("Test case #%d", i))
+		assert.Equal(t, tc.want, sKeyIDsAll(tc.entity), fmt.Sprintf("Test case #%d", i))
 	}
 }
 
-func TestSKeyIDsAll(t *testing.T) {
+func TestSKeyQuarantine(t *testing.T) {
 	cases := []struct {
 		entity string
 		want   string
 	}{
-		{"users", "users:all_ids"},
-		{"", ":all_ids"},
-		{"users:students", "users:students:all_ids"},
-		{"users_students", "users_students:all_ids"},
+		{"users", "users:quarantine"},
+		{"users:students", "users:students:quarantine"},
 	}
 	for i, tc := range cases {
-		assert.Equal(t, tc.want, sKeyIDsAll(tc.entity), fmt.Sprintf("Test case #%d", i))
+		assert.Equal(t, tc.want, sKeyQuarantine(tc.entity), fmt.Sprintf("Test case #%d", i))
 	}
 }
 
+func TestTmpKey(t *testing.T) {
+	assert.Regexp(t, `^users:tmp_\d+_\d+$`, tmpKey("users"))
+	assert.Regexp(t, `^\{users\}:tmp_\d+_\d+$`, tmpKey("{users}"))
+	assert.NotEqual(t, tmpKey("users"), tmpKey("users"))
+}
+
 func TestAuxIndexListKey(t *testing.T) {
 	cases := []struct {
 		id     string
@@ -89,3 +120,57 @@ func TestAuxIndexListKey(t *testing.T) {
 		assert.Equal(t, tc.want, auxIndexListKey(tc.id, tc.sorted), fmt.Sprintf("Test case #%d", i))
 	}
 }
+
+func TestEscapeKeyPart(t *testing.T) {
+	cases := []struct {
+		part interface{}
+		want string
+	}{
+		{"bob", "bob"},
+		{"New York", "New York"},
+		{"a:b", "a%3Ab"},
+		{"*?[]", "%2A%3F%5B%5D"},
+		{"{tag}", "%7Btag%7D"},
+		{`\`, "%5C"},
+		{"100%", "100%25"},
+		{"%3A", "%253A"},
+		{42, "42"},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, escapeKeyPart(tc.part), fmt.Sprintf("Test case #%d", i))
+		assert.Equal(t, fmt.Sprint(tc.part), unescapeKeyPart(tc.want), fmt.Sprintf("Test case #%d", i))
+	}
+}
+
+func TestKeyspace(t *testing.T) {
+	escaped := keyspace{prefix: "users", encoding: EscapedKeys}
+	assert.Equal(t, "users:item:a%3Ab", escaped.item("a:b"))
+	assert.Equal(t, "users:set:na%3Ame:New%3AYork%2A", escaped.set("na:me", "New:York*"))
+	assert.Equal(t, "users:set:na%3Ame", escaped.registry("na:me"))
+	assert.Equal(t, "users:set:", escaped.registered())
+	assert.Equal(t, "users:zset:age", escaped.zset("age"))
+	assert.Equal(t, "users:ids", escaped.allIDs())
+	assert.Equal(t, "users:quarantine", escaped.quarantine())
+	assert.Equal(t, "users:keys_version", escaped.keysVersion())
+	assert.Regexp(t, `^users:tmp_\d+_\d+$`, escaped.tmp())
+
+	elems, ok := escaped.elements("comments")
+	assert.True(t, ok)
+	assert.Equal(t, "users:set:comments.author:Bob", elems.set("author", "Bob"))
+	assert.Equal(t, "users:zset:comments.likes", elems.zset("likes"))
+	assert.Equal(t, "users:elems:comments", elems.allIDs())
+	assert.Equal(t, "", elems.exists("author"))
+	_, ok = elems.elements("replies")
+	assert.False(t, ok)
+
+	plain := keyspace{prefix: "users", encoding: PlainKeys}
+	assert.Equal(t, "users:a:b", plain.item("a:b"))
+	assert.Equal(t, "users:name:New:York", plain.set("name", "New:York"))
+	assert.Equal(t, "", plain.registry("name"))
+	assert.Equal(t, "", plain.registered())
+	assert.Equal(t, "users:age", plain.zset("age"))
+	assert.Equal(t, "users:all_ids", plain.allIDs())
+	assert.Equal(t, "users:keys_version", plain.keysVersion())
+	_, ok = plain.elements("comments")
+	assert.False(t, ok)
+}
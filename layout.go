@@ -0,0 +1,134 @@
+package rds
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Layout defines how an item is stored in its Redis hash.
+type Layout int
+
+const (
+	// FieldsLayout stores every top-level field of an item's payload as a separate hash field.
+	// Scalar values are stored as plain strings (numbers in decimal notation, time as Unix nanoseconds),
+	// so that Redis-side commands like SORT ... BY and HMGET work on real values.
+	// Other values (maps, slices, etc.) are encoded with the Handler's Codec.
+	// Go types of the values are kept in a separate hash field, so that they are restored on read.
+	FieldsLayout Layout = iota
+	// BlobLayout stores the whole payload of an item encoded with the Handler's Codec in a single hash field.
+	// This is how items were stored by the earlier versions (with GobCodec), so use it to work with the existing data.
+	BlobLayout
+)
+
+const (
+	// typesField is a hash field with Go types of the payload fields stored with FieldsLayout.
+	typesField = "_types"
+)
+
+// name returns a name of the layout. It's stored in the keys version marker of an entity.
+func (l Layout) name() string {
+	if l == BlobLayout {
+		return "blob"
+	}
+	return "fields"
+}
+
+// hashFields returns names of the hash fields that should be fetched to get an item stored with the layout.
+// Payload fields are top-level fields of a resource schema.
+func (l Layout) hashFields(payloadFields []string) []string {
+	if l == BlobLayout {
+		return []string{ETagField, payloadField}
+	}
+	return append([]string{ETagField, typesField}, payloadFields...)
+}
+
+// encodeFieldValue converts a payload field value to a string suitable for a hash field of FieldsLayout.
+// Returns the value's type name to be stored along with it, and the encoded value itself.
+// Values that are not scalars are encoded with the codec, and the codec's name is used as their type.
+func encodeFieldValue(codec Codec, v interface{}) (string, string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "nil", "", nil
+	case string:
+		return "string", val, nil
+	case bool:
+		return "bool", strconv.FormatBool(val), nil
+	case int:
+		return "int", strconv.FormatInt(int64(val), 10), nil
+	case int8:
+		return "int8", strconv.FormatInt(int64(val), 10), nil
+	case int16:
+		return "int16", strconv.FormatInt(int64(val), 10), nil
+	case int32:
+		return "int32", strconv.FormatInt(int64(val), 10), nil
+	case int64:
+		return "int64", strconv.FormatInt(val, 10), nil
+	case float32:
+		return "float32", strconv.FormatFloat(float64(val), 'f', -1, 32), nil
+	case float64:
+		return "float64", strconv.FormatFloat(val, 'f', -1, 64), nil
+	case time.Time:
+		return "time", strconv.FormatInt(val.UnixNano(), 10), nil
+	default:
+		encoded, err := codec.Marshal(&v)
+		if err != nil {
+			return "", "", err
+		}
+		return codec.Name(), string(encoded), nil
+	}
+}
+
+// isScalarType checks if a type of FieldsLayout value denotes a scalar, i.e. a value that is not encoded by a codec.
+func isScalarType(typ string) bool {
+	switch typ {
+	case "nil", "string", "bool", "int", "int8", "int16", "int32", "int64", "float32", "float64", "time":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeFieldValue converts a hash field value of FieldsLayout back to a payload field value of the given type.
+// Values encoded with a codec are decoded with the built-in codec of the same name or with the given codec.
+func decodeFieldValue(codec Codec, typ, value string) (interface{}, error) {
+	switch typ {
+	case "nil":
+		return nil, nil
+	case "string":
+		return value, nil
+	case "bool":
+		return strconv.ParseBool(value)
+	case "int":
+		v, err := strconv.ParseInt(value, 10, 0)
+		return int(v), err
+	case "int8":
+		v, err := strconv.ParseInt(value, 10, 8)
+		return int8(v), err
+	case "int16":
+		v, err := strconv.ParseInt(value, 10, 16)
+		return int16(v), err
+	case "int32":
+		v, err := strconv.ParseInt(value, 10, 32)
+		return int32(v), err
+	case "int64":
+		return strconv.ParseInt(value, 10, 64)
+	case "float32":
+		v, err := strconv.ParseFloat(value, 32)
+		return float32(v), err
+	case "float64":
+		return strconv.ParseFloat(value, 64)
+	case "time":
+		v, err := strconv.ParseInt(value, 10, 64)
+		return time.Unix(0, v), err
+	}
+
+	if c, ok := codecs[typ]; ok {
+		codec = c
+	} else if typ != codec.Name() {
+		return nil, fmt.Errorf("unknown type of a stored value: %q", typ)
+	}
+	var v interface{}
+	err := codec.Unmarshal([]byte(value), &v)
+	return v, err
+}
@@ -0,0 +1,93 @@
+package rds
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodeFieldValue(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		value       interface{}
+		wantType    string
+		wantEncoded string
+	}{
+		{nil, "nil", ""},
+		{"foo", "string", "foo"},
+		{"", "string", ""},
+		{"O'Brien:*", "string", "O'Brien:*"},
+		{true, "bool", "true"},
+		{false, "bool", "false"},
+		{35, "int", "35"},
+		{-35, "int", "-35"},
+		{int8(7), "int8", "7"},
+		{int16(7), "int16", "7"},
+		{int32(7), "int32", "7"},
+		{int64(99999999999), "int64", "99999999999"},
+		{float32(1.5), "float32", "1.5"},
+		{185.54576, "float64", "185.54576"},
+		{155.0, "float64", "155"},
+		{now, "time", fmt.Sprintf("%d", now.UnixNano())},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		typ, encoded, err := encodeFieldValue(GobCodec, tc.value)
+		assert.NoError(t, err, msg)
+		assert.Equal(t, tc.wantType, typ, msg)
+		assert.Equal(t, tc.wantEncoded, encoded, msg)
+
+		decoded, err := decodeFieldValue(GobCodec, typ, encoded)
+		assert.NoError(t, err, msg)
+		if v, ok := tc.value.(time.Time); ok {
+			assert.True(t, v.Equal(decoded.(time.Time)), msg)
+		} else {
+			assert.Equal(t, tc.value, decoded, msg)
+		}
+	}
+}
+
+func TestEncodeDecodeFieldValue_Complex(t *testing.T) {
+	cases := []interface{}{
+		map[string]interface{}{"title": "foo", "body": "bar"},
+		[]interface{}{"a", "b"},
+		[]string{"a", "b"},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		typ, encoded, err := encodeFieldValue(GobCodec, tc)
+		assert.NoError(t, err, msg)
+		assert.Equal(t, "gob", typ, msg)
+
+		decoded, err := decodeFieldValue(GobCodec, typ, encoded)
+		assert.NoError(t, err, msg)
+		assert.Equal(t, tc, decoded, msg)
+	}
+}
+
+func TestDecodeFieldValue_Errors(t *testing.T) {
+	cases := []struct {
+		typ   string
+		value string
+	}{
+		{"int", "foo"},
+		{"int8", "1000"},
+		{"float64", "bar"},
+		{"bool", "maybe"},
+		{"time", "yesterday"},
+		{"gob", "not a gob"},
+		{"unknown", "foo"},
+	}
+	for i, tc := range cases {
+		_, err := decodeFieldValue(GobCodec, tc.typ, tc.value)
+		assert.Error(t, err, fmt.Sprintf("Test case #%d", i))
+	}
+}
+
+func TestLayoutHashFields(t *testing.T) {
+	fields := []string{"age", "id", "name"}
+	assert.Equal(t, []string{"_etag", "_types", "age", "id", "name"}, FieldsLayout.hashFields(fields))
+	assert.Equal(t, []string{"_etag", "payload"}, BlobLayout.hashFields(fields))
+}
@@ -2,9 +2,7 @@ package rds
 
 import (
 	"fmt"
-	"sort"
 
-	"github.com/rs/rest-layer/resource"
 	"github.com/rs/rest-layer/schema/query"
 )
 
@@ -14,13 +12,38 @@ type LuaQuery struct {
 	Script string
 	// LastKey is the key where the ids against which the final query will be executed.
 	LastKey string
+	// LastIDs is the Lua variable holding the ids against which the final query will be executed in read-only mode.
+	LastIDs string
 	// AllKeys are temporary keys created in Redis during Query building process.
 	// They should be eventually deleted after query returned some result.
 	AllKeys []string
+	// SortInLua makes the query sort items in Lua even by a single field instead of using SORT BY and GET.
+	// Redis Cluster doesn't allow SORT patterns that may refer to keys in other slots.
+	SortInLua bool
+	// ReadOnly makes the query write nothing: the found ids are collected into Lua tables instead of temporary keys,
+	// unless they are already held by a single key (see singleKey). It's reset if the predicate can't be translated so
+	// (see isReadOnly).
+	ReadOnly bool
+	// KEYS and ARGV the Script should be run with.
+	// LastKey and AllKeys are the Lua expressions referring to them.
+	luaParams
 }
 
-func (lq *LuaQuery) addSelect(entityName string, q *query.Query) error {
-	lastKey, script, tempKeys, err := translatePredicate(entityName, normalizePredicate(q.Predicate))
+func (lq *LuaQuery) addSelect(ks keyspace, q *query.Query) error {
+	predicate := normalizePredicate(q.Predicate)
+	// A single key is sorted with SORT BY and GET inside Redis, which doesn't write anything either
+	if key, ok := singleKey(ks, predicate); ok && lq.ReadOnly && !lq.SortInLua {
+		lq.LastKey = lq.key(key)
+		return nil
+	}
+	if lq.ReadOnly && isReadOnly(predicate) {
+		lastIDs, script, err := translatePredicateReadOnly(&lq.luaParams, ks, predicate)
+		lq.Script = luaIDLists + script
+		lq.LastIDs = lastIDs
+		return err
+	}
+	lq.ReadOnly = false
+	lastKey, script, tempKeys, err := translatePredicate(&lq.luaParams, ks, predicate)
 	lq.Script = script
 	lq.LastKey = lastKey
 	lq.AllKeys = tempKeys
@@ -28,69 +51,224 @@ func (lq *LuaQuery) addSelect(entityName string, q *query.Query) error {
 }
 
 func (lq *LuaQuery) addSortWithLimit(q *query.Query, limit, offset int, fields, numeric []string) error {
-	// Redis supports only one sort field.
-	if len(q.Sort) > 1 {
-		// todo - ErrNotImplemented ???
-		return resource.ErrNotImplemented
+	// Redis SORT supports only one sort field, so sorting by many of them is done in Lua.
+	// SORT can't sort ids collected in Lua as well.
+	if len(q.Sort) > 1 || lq.SortInLua || lq.LastIDs != "" {
+		lq.addLuaSortWithLimit(q, limit, offset, fields, numeric)
+		return nil
 	}
 
 	sortByField := "__nosort__"
 	direction := "ASC"
-	resultVar := tmpVar()
+	numericSort := false
+	resultVar := lq.newVar()
+	totalVar := lq.newVar()
 
-	// todo - range q.sort - in order to sort by multiple
 	// If sort is set, it' means we definitely use some real field, not a "nosort"
 	// Determine sort direction and sort field
 	if len(q.Sort) != 0 {
 		sortByField = "*->" + q.Sort[0].Name
+		numericSort = inSlice(q.Sort[0].Name, numeric)
 		if q.Sort[0].Reversed {
 			direction = "DESC"
 		}
 	}
 
+	// Count all the found items before limit and offset cut them
+	lq.addCount(totalVar)
+
 	// First, we are sorting the set with all IDs
-	lq.Script += fmt.Sprintf("\n local %s = redis.call('SORT', '%s', 'BY'", resultVar, lq.LastKey)
+	lq.Script += fmt.Sprintf("\n local %s = redis.call('SORT', %s, 'BY'", resultVar, lq.LastKey)
 
 	// Add sorter field
-	// TODO - inSlice
-	if sort.SearchStrings(numeric, sortByField) > 0 {
-		lq.Script += fmt.Sprintf(", '%s', '%s'", sortByField, direction)
+	if numericSort {
+		lq.Script += fmt.Sprintf(", %s, '%s'", lq.arg(sortByField), direction)
 	} else {
-		lq.Script += fmt.Sprintf(", '%s', 'ALPHA', '%s'", sortByField, direction)
+		lq.Script += fmt.Sprintf(", %s, 'ALPHA', '%s'", lq.arg(sortByField), direction)
 	}
 
-	// Add all fields to a result of a sort
+	// Add the item's key and all fields to a result of a sort
+	lq.Script += ", 'GET', '#'"
 	for _, v := range fields {
-		lq.Script += fmt.Sprintf(", 'GET', '*->%s'", v)
+		lq.Script += fmt.Sprintf(", 'GET', %s", lq.arg("*->"+v))
 	}
 
 	// Add limit and offset
-	lq.Script += fmt.Sprintf(", 'LIMIT', %d, %d)", offset, limit)
+	lq.Script += fmt.Sprintf(", 'LIMIT', %s, %s)", lq.arg(offset), lq.arg(limit))
 
 	// Delete everything we've created previously
 	lq.deleteTemporaryKeys()
 
-	// Return the result
-	lq.Script += fmt.Sprintf("\n return %s", resultVar)
+	// Return the total count along with the result
+	lq.Script += fmt.Sprintf("\n return {%s, %s}", totalVar, resultVar)
 	return nil
 }
 
-func (lq *LuaQuery) addDelete(entityName string) {
-	resultVar := tmpVar()
+// addLuaSortWithLimit sorts found IDs in Lua, possibly by several fields at once.
+// Values of the sort fields are fetched from the items hashes and compared one by one, each in its own direction.
+// Numeric fields are compared as numbers, others - as strings. Ties are resolved by item keys.
+// The result has the same layout as the one of SORT ... GET # GET ...: a key and values of requested fields, item after item.
+// Keys of the items are found by the query, so they aren't declared in KEYS: they are in the same slot of Redis Cluster
+// as the declared keys since all keys of an entity share its hash tag.
+func (lq *LuaQuery) addLuaSortWithLimit(q *query.Query, limit, offset int, fields, numeric []string) {
+	resultVar := lq.newVar()
+	totalVar := lq.newVar()
+
+	var sortFields, sortSpecs, getFields []string
+	for _, v := range q.Sort {
+		sortFields = append(sortFields, lq.arg(v.Name))
+		sortSpecs = append(sortSpecs, fmt.Sprintf("{desc = %t, numeric = %t}", v.Reversed, inSlice(v.Name, numeric)))
+	}
+	for _, v := range fields {
+		getFields = append(getFields, lq.arg(v))
+	}
+
+	// Count all the found items before limit and offset cut them
+	lq.addCount(totalVar)
+
+	lq.Script += fmt.Sprintf(`
+		local %[1]s = {}
+		do
+			local ids
+			%[2]s
+
+			-- Fetch values to sort by. Missing ones are treated as SORT does: 0 or an empty string.
+			local sort_fields = %[3]s
+			local sort_specs = %[4]s
+			local sort_values = {}
+			for _, id in ipairs(ids) do
+				local values = {}
+				if #sort_fields > 0 then
+					values = redis.call('HMGET', id, unpack(sort_fields))
+				end
+				for i, spec in ipairs(sort_specs) do
+					if spec.numeric then
+						values[i] = tonumber(values[i]) or 0
+					else
+						values[i] = values[i] or ''
+					end
+				end
+				sort_values[id] = values
+			end
+
+			-- Without sort fields ids are kept in the order they were found in, as SORT BY does
+			if #sort_specs > 0 then
+				table.sort(ids, function(a, b)
+					for i, spec in ipairs(sort_specs) do
+						local x, y = sort_values[a][i], sort_values[b][i]
+						if x ~= y then
+							if spec.desc then
+								return x > y
+							end
+							return x < y
+						end
+					end
+					return a < b
+				end)
+			end
+
+			-- Apply offset and limit and get all the fields of the remaining items
+			local offset, limit = tonumber(%[5]s), tonumber(%[6]s)
+			local last = #ids
+			if limit >= 0 and offset + limit < last then
+				last = offset + limit
+			end
+			local get_fields = %[7]s
+			for i = offset + 1, last do
+				table.insert(%[1]s, ids[i])
+				for _, v in ipairs(redis.call('HMGET', ids[i], unpack(get_fields))) do
+					table.insert(%[1]s, v)
+				end
+			end
+		end
+		`,
+		resultVar,
+		lq.fetchIDs("ids"),
+		makeLuaTable(sortFields),
+		makeLuaTable(sortSpecs),
+		lq.arg(offset),
+		lq.arg(limit),
+		makeLuaTable(getFields))
+
+	// Delete everything we've created previously
+	lq.deleteTemporaryKeys()
+
+	// Return the total count along with the result
+	lq.Script += fmt.Sprintf("\n return {%s, %s}", totalVar, resultVar)
+}
+
+// singleKey returns a key holding the IDs of the items matching a predicate if there is such a key:
+// the set of all IDs if there is no predicate, or a set index of a single value.
+func singleKey(ks keyspace, predicate query.Predicate) (string, bool) {
+	if len(predicate) == 0 {
+		return ks.allIDs(), true
+	}
+	if t, ok := predicate[0].(*query.Equal); ok && len(predicate) == 1 && !numeric(ks, t.Field, t.Value) {
+		return ks.set(t.Field, t.Value), true
+	}
+	return "", false
+}
+
+// fetchIDs returns a Lua snippet that assigns a list of the found IDs to a Lua variable.
+func (lq *LuaQuery) fetchIDs(resultVar string) string {
+	if lq.LastIDs != "" {
+		return fmt.Sprintf("%s = %s", resultVar, lq.LastIDs)
+	}
+	return fmt.Sprintf(`if redis.call('TYPE', %[2]s).ok == 'zset' then
+				%[1]s = redis.call('ZRANGE', %[2]s, 0, -1)
+			else
+				-- If not zset then it's a set
+				%[1]s = redis.call('SMEMBERS', %[2]s)
+			end`, resultVar, lq.LastKey)
+}
+
+// addCount stores the number of IDs found at LastKey (or LastIDs) in a Lua variable.
+func (lq *LuaQuery) addCount(resultVar string) {
+	if lq.LastIDs != "" {
+		lq.Script += fmt.Sprintf("\n local %s = #%s", resultVar, lq.LastIDs)
+		return
+	}
+	lq.Script += fmt.Sprintf(`
+		local %[1]s
+		if redis.call('TYPE', %[2]s).ok == 'zset' then
+			%[1]s = redis.call('ZCARD', %[2]s)
+		else
+			-- If not zset then it's a set
+			%[1]s = redis.call('SCARD', %[2]s)
+		end
+		`, resultVar, lq.LastKey)
+}
+
+// addReturnCount makes the query return the number of the found IDs.
+func (lq *LuaQuery) addReturnCount() {
+	totalVar := lq.newVar()
+	lq.addCount(totalVar)
+
+	// Delete everything we've created previously
+	lq.deleteTemporaryKeys()
+
+	lq.Script += fmt.Sprintf("\n return %s", totalVar)
+}
+
+func (lq *LuaQuery) addDelete(ks keyspace) {
+	resultVar := lq.newVar()
 
 	// Delete all the entities we were asked to delete.
 	// Also delete all the secondary indices (and auxiliary lists) for those entities.
 	// Get and return the count of records that are going to be deleted.
-	lq.Script += fmt.Sprintf(`
+	// Keys of the items are found by the query and keys of their indices are taken from the auxiliary lists,
+	// so they aren't declared in KEYS: they are in the same slot of Redis Cluster since they share the entity's hash tag.
+	lq.Script += luaRegistries + luaRemoveElems + fmt.Sprintf(`
+		registries = %[7]s ~= '' and %[7]s
 		local %[5]s
 		local %[1]s
-		if redis.call('TYPE', '%[2]s') == 'zset' then
-			%[5]s = redis.call('ZCARD', '%[2]s')
-			%[1]s = redis.call('ZRANGE', '%[2]s', 0, -1)
+		if redis.call('TYPE', %[2]s).ok == 'zset' then
+			%[5]s = redis.call('ZCARD', %[2]s)
+			%[1]s = redis.call('ZRANGE', %[2]s, 0, -1)
 		else
 			-- If not zset then it's a set
-			%[5]s = redis.call('SCARD', '%[2]s')
-			%[1]s = redis.call('SMEMBERS', '%[2]s')
+			%[5]s = redis.call('SCARD', %[2]s)
+			%[1]s = redis.call('SMEMBERS', %[2]s)
 		end
 
 		for _, v in ipairs(%[1]s) do
@@ -98,7 +276,7 @@ func (lq *LuaQuery) addDelete(entityName string) {
 			redis.call('DEL', v)
 
 			-- delete secondary ZSet indices
-			local idx_sorted_name = v .. '%[3]s'
+			local idx_sorted_name = v .. ':' .. %[3]s
 			local idx_sorted = redis.call('SMEMBERS', idx_sorted_name)
 			for _, i in ipairs(idx_sorted) do
 				redis.call('ZREM', i, v)
@@ -107,24 +285,32 @@ func (lq *LuaQuery) addDelete(entityName string) {
 			redis.call('DEL', idx_sorted_name)
 
 			-- delete secondary Set indices
-			local idx_non_sorted_name = v .. '%[4]s'
+			local idx_non_sorted_name = v .. ':' .. %[4]s
 			local idx_non_sorted = redis.call('SMEMBERS', idx_non_sorted_name)
 			for _, i in ipairs(idx_non_sorted) do
 				redis.call('SREM', i, v)
+				unregister_set(i)
 			end
 			-- delete auxiliary list of set (non-sorted values) indices
 			redis.call('DEL', idx_non_sorted_name)
 
+			-- delete indices of array elements and their auxiliary list
+			local idx_elem_name = v .. ':' .. %[8]s
+			remove_elems(v, idx_elem_name)
+			redis.call('DEL', idx_elem_name)
+
 			-- delete item from all IDs set
-			redis.call('SREM', '%[6]s', v)
+			redis.call('SREM', %[6]s, v)
 		end
 		`,
-		tmpVar(),
+		lq.newVar(),
 		lq.LastKey,
-		auxIndexListSortedSuffix,
-		auxIndexListNonSortedSuffix,
+		lq.arg(auxIndexListSortedSuffix),
+		lq.arg(auxIndexListNonSortedSuffix),
 		resultVar,
-		sKeyIDsAll(entityName))
+		lq.key(ks.allIDs()),
+		lq.arg(ks.registered()),
+		lq.arg(auxIndexListElemSuffix))
 
 	// Delete everything we've created previously
 	lq.deleteTemporaryKeys()
@@ -138,6 +324,6 @@ func (lq *LuaQuery) deleteTemporaryKeys() {
 	// todo - isn't it too early?
 	//lq.AllKeys = append(lq.AllKeys, lq.LastKey)
 	if len(lq.AllKeys) > 0 {
-		lq.Script = lq.Script + fmt.Sprintf("\n redis.call('DEL', unpack(%s))", makeLuaTableFromStrings(lq.AllKeys))
+		lq.Script = lq.Script + fmt.Sprintf("\n redis.call('DEL', unpack(%s))", makeLuaTable(lq.AllKeys))
 	}
 }
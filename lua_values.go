@@ -3,97 +3,109 @@ package rds
 import (
 	"fmt"
 	"math/rand"
-	"sort"
 	"strings"
 	"time"
-	"errors"
-
-	"github.com/rs/rest-layer/schema/query"
 )
 
-// getRangeNumericPairs creates consequent combinations of ASC-sorted input elements.
-// Values are supposed to be numeric.
-// And all of them are cast to either int or float64 to make heterogeneous elements sorting.
-// If input contains both ints and floats - error is returned.
-// If input contains non-numeric values - error is returned.
-// Is used for creating range tuples for Lua.
-// Ex: [4, 77, 15, 9, 0] -> ["{'-inf',0}", "{0,4}", "{4,9}", ... "{77,'+inf'}"]
-func getRangeNumericPairs(in []query.Value) ([]string, error) {
-	toSortInts := make([]int, 0, len(in))
-	toSortFloats := make([]float64, 0, len(in))
-	stringedNums := []string{"'-inf'"}
-	allInts, allFloats := true, true
+// luaParams collects KEYS and ARGV that are passed to a Lua script along with its source.
+// Any value that comes from outside (query values, keys derived from them, etc.) should be bound through it,
+// so that it never becomes a part of the script text itself.
+type luaParams struct {
+	// Keys are passed to the script as KEYS.
+	Keys []string
+	// Args are passed to the script as ARGV.
+	Args []interface{}
+	// keyLists and argLists are bound after Keys and Args (see bound).
+	keyLists, argLists []boundList
+	// vars is a count of Lua variables declared in the script so far.
+	vars int
+}
 
-	if len(in) == 0 {
-		return []string{"{'-inf','+inf'}"}, nil
-	}
+// boundList is a list of keys or values bound as a range of KEYS or ARGV.
+// The range isn't known until all the params are bound, so its bounds are passed in Args at the given positions.
+type boundList struct {
+	values     []interface{}
+	first, last int
+}
 
-	for _, i := range in {
-		switch v := i.(type) {
-		case float32, float64:
-			allInts = false
-			toSortFloats = append(toSortFloats, toFloat64(v))
-		case int, int8, int16, int32, int64:
-			allFloats = false
-			toSortInts = append(toSortInts, toInt(v))
-		default:
-			allInts = false
-			allFloats = false
-		}
+// luaRange is a Lua expression that collects a range of KEYS or ARGV with the bounds taken from ARGV into a table.
+const luaRange = "(function() local t = {} for i = tonumber(ARGV[%[2]d]), tonumber(ARGV[%[3]d]) do table.insert(t, %[1]s[i]) end return t end)()"
+
+// key binds a Redis key and returns a Lua expression that refers to it.
+// Ex: users:hair:brown -> KEYS[3]
+func (p *luaParams) key(k string) string {
+	p.Keys = append(p.Keys, k)
+	return fmt.Sprintf("KEYS[%d]", len(p.Keys))
+}
+
+// arg binds a value and returns a Lua expression that refers to it.
+// Ex: 'brown' -> ARGV[2]
+func (p *luaParams) arg(v interface{}) string {
+	p.Args = append(p.Args, v)
+	return fmt.Sprintf("ARGV[%d]", len(p.Args))
+}
+
+// keysTable binds Redis keys and returns a Lua table that refers to them.
+// Keys are bound as a range of KEYS, so that the script text doesn't depend on how many of them there are.
+// Ex: [users:hair:brown, users:hair:red] -> a table of KEYS[ARGV[3]] .. KEYS[ARGV[4]]
+func (p *luaParams) keysTable(keys []string) string {
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, k)
 	}
+	list := p.newList(values)
+	p.keyLists = append(p.keyLists, list)
+	return fmt.Sprintf(luaRange, "KEYS", list.first+1, list.last+1)
+}
 
-	if allInts {
-		sort.Ints(toSortInts)
-		for _, i := range toSortInts {
-			stringedNums = append(stringedNums, fmt.Sprintf("%d", i))
-		}
-	} else if allFloats {
-		sort.Float64s(toSortFloats)
-		for _, i := range toSortFloats {
-			stringedNums = append(stringedNums, fmt.Sprintf("%.6f", i))
+// argsTable binds values and returns a Lua table that refers to them.
+// Values are bound as a range of ARGV, so that the script text doesn't depend on how many of them there are.
+// Ex: [24, 56] -> a table of ARGV[ARGV[3]] .. ARGV[ARGV[4]]
+func (p *luaParams) argsTable(values []interface{}) string {
+	list := p.newList(values)
+	p.argLists = append(p.argLists, list)
+	return fmt.Sprintf(luaRange, "ARGV", list.first+1, list.last+1)
+}
+
+// newList reserves Args for the bounds of a list.
+func (p *luaParams) newList(values []interface{}) boundList {
+	p.Args = append(p.Args, 0, 0)
+	return boundList{values: values, first: len(p.Args) - 2, last: len(p.Args) - 1}
+}
+
+// bound returns all the keys and values to be passed to the script: Keys and Args followed by the bound lists.
+func (p *luaParams) bound() ([]string, []interface{}) {
+	keys := append([]string(nil), p.Keys...)
+	args := append([]interface{}(nil), p.Args...)
+	for _, l := range p.keyLists {
+		args[l.first] = len(keys) + 1
+		for _, v := range l.values {
+			keys = append(keys, v.(string))
 		}
-	} else {
-		return []string{}, errors.New("input data has mixed values type: accepted only integers or floats")
+		args[l.last] = len(keys)
 	}
-
-	var out []string
-	stringedNums = append(stringedNums, "'+inf'")
-	for i := 1; i < len(stringedNums); i++ {
-		var tuple = fmt.Sprintf("{%s,%s}", stringedNums[i - 1], stringedNums[i])
-		out = append(out, tuple)
+	for _, l := range p.argLists {
+		args[l.first] = len(args) + 1
+		args = append(args, l.values...)
+		args[l.last] = len(args)
 	}
-	return out, nil
+	return keys, args
 }
 
-// Get a Lua table definition based on given values.
-func makeLuaTableFromStrings(a []string) string {
-	aQuoted := make([]string, 0, len(a))
-	for _, v := range a {
-		aQuoted = append(aQuoted, fmt.Sprintf("'%s'", v))
-	}
-	return fmt.Sprintf("{" + strings.Join(aQuoted, ",") + "}")
+// newVar returns a name for a Lua variable that is unique within the script.
+// Names are sequential rather than random, so that the same script text is generated for the same query shape.
+// Ex: var_1, var_2
+func (p *luaParams) newVar() string {
+	p.vars++
+	return fmt.Sprintf("var_%d", p.vars)
 }
 
-// Get a Lua table definition based on given values.
-func makeLuaTableFromValues(a []query.Value) string {
-	aQuoted := make([]string, 0, len(a))
-	for _, v := range a {
-		aQuoted = append(aQuoted, quoteValue(v))
-	}
-	return fmt.Sprintf("{%s}", strings.Join(aQuoted, ","))
+// Get a Lua table definition based on given Lua expressions.
+func makeLuaTable(a []string) string {
+	return fmt.Sprintf("{%s}", strings.Join(a, ","))
 }
 
-// Generate random string suited for temporary Lua variable and Redis key
+// Generate random string suited for temporary Redis key
 func tmpVar() string {
 	return fmt.Sprintf("tmp_%d_%d", rand.Int(), time.Now().UnixNano())
 }
-
-// quoteValue returns quoted or unquoted value for Lua consumption
-func quoteValue(v interface{}) string {
-	switch val := v.(type) {
-	case string, bool:
-		return fmt.Sprintf("'%v'", val)
-	default:
-		return fmt.Sprintf("%v", val)
-	}
-}
@@ -0,0 +1,355 @@
+package rds
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/rest-layer/resource"
+)
+
+const (
+	// Error replies returned by the write scripts. They are mapped to rest-layer errors by scriptError.
+	errReplyConflict = "CONFLICT"
+	errReplyNotFound = "NOT_FOUND"
+)
+
+// luaReadItem is a Lua function that reads an item to write from KEYS and ARGV starting at the given positions.
+// KEYS: the item's hash key, auxiliary lists of its set, zset and elements indices, set indices,
+// registries of the set indices (if registries are maintained), zset indices, sets of items having values of fields,
+// indices of array elements, each one followed by its registry if it's a registered set.
+// ARGV: number of hash fields, number of set indices, number of zset indices, number of sets of items having values,
+// number of indices of array elements, hash field-value pairs, scores of zset indices,
+// kind-position-score triples of indices of array elements.
+// Returns the item and positions of the next item's KEYS and ARGV.
+const luaReadItem = `
+	local function read_item(k, a)
+		local item = {key = KEYS[k], set_list = KEYS[k + 1], zset_list = KEYS[k + 2], elem_list = KEYS[k + 3]}
+		k = k + 4
+		local nfields, nsets, nzsets = tonumber(ARGV[a]), tonumber(ARGV[a + 1]), tonumber(ARGV[a + 2])
+		local nexists, nelems = tonumber(ARGV[a + 3]), tonumber(ARGV[a + 4])
+		a = a + 5
+		item.fields = {unpack(ARGV, a, a + 2 * nfields - 1)}
+		a = a + 2 * nfields
+		item.scores = {unpack(ARGV, a, a + nzsets - 1)}
+		a = a + nzsets
+		item.sets = {unpack(KEYS, k, k + nsets - 1)}
+		k = k + nsets
+		item.registries = {}
+		if registries then
+			item.registries = {unpack(KEYS, k, k + nsets - 1)}
+			k = k + nsets
+		end
+		item.zsets = {unpack(KEYS, k, k + nzsets - 1)}
+		k = k + nzsets
+		item.exists = {unpack(KEYS, k, k + nexists - 1)}
+		k = k + nexists
+		item.elems = {}
+		for i = 0, nelems - 1 do
+			local e = {key = KEYS[k], kind = ARGV[a + 3 * i], elem = ARGV[a + 3 * i + 1], score = ARGV[a + 3 * i + 2]}
+			k = k + 1
+			if registries and e.kind == '` + elemSet + `' then
+				e.registry = KEYS[k]
+				k = k + 1
+			end
+			table.insert(item.elems, e)
+		end
+		return item, k, a + 3 * nelems
+	end
+`
+
+// luaRegistries are Lua functions that maintain registries of set indices of each field (see keyspace.registry).
+// Registries are maintained only if registries variable is set to the prefix of keys of set indices
+// (see keyspace.registered). Registries of the written sets are declared in KEYS. Sets to unregister are taken from
+// the auxiliary lists of items, so their registries can't be: with EscapedKeys a registry is the key of a set index
+// without the value part. It's in the same slot of Redis Cluster as the set, since all keys of an entity share
+// its hash tag.
+const luaRegistries = `
+	local registries = false
+	local function registry_of(set)
+		return string.match(set, '^(.*):[^:]*$')
+	end
+	local function register_set(set, registry)
+		if registries then
+			redis.call('SADD', registry, set)
+		end
+	end
+	local function unregister_set(set)
+		-- Auxiliary lists hold sets of items having values as well, they are not registered
+		if registries and string.sub(set, 1, #registries) == registries and redis.call('EXISTS', set) == 0 then
+			redis.call('SREM', registry_of(set), set)
+		end
+	end
+`
+
+// luaWriteItem is a Lua function that writes an item read by read_item along with its secondary indices
+// and adds it to the set of all IDs passed as KEYS[1].
+const luaWriteItem = `
+	local function write_item(item)
+		redis.call('HMSET', item.key, unpack(item.fields))
+		for i, s in ipairs(item.sets) do
+			redis.call('SADD', s, item.key)
+			register_set(s, item.registries[i])
+		end
+		if #item.sets > 0 then
+			redis.call('SADD', item.set_list, unpack(item.sets))
+		end
+		-- Sets of items having values are removed along with set indices, but they are not registered
+		for _, s in ipairs(item.exists) do
+			redis.call('SADD', s, item.key)
+		end
+		if #item.exists > 0 then
+			redis.call('SADD', item.set_list, unpack(item.exists))
+		end
+		for i, z in ipairs(item.zsets) do
+			redis.call('ZADD', z, item.scores[i], item.key)
+		end
+		if #item.zsets > 0 then
+			redis.call('SADD', item.zset_list, unpack(item.zsets))
+		end
+		-- Members of indices of array elements are the item's key followed by the element's position.
+		-- They are listed as kind, position and key of the index, e.g. 's0 users:set:comments.author:Bob'
+		for _, e in ipairs(item.elems) do
+			local member = item.key .. ':' .. e.elem
+			if e.kind == '` + elemZSet + `' then
+				redis.call('ZADD', e.key, e.score, member)
+			else
+				redis.call('SADD', e.key, member)
+				if e.kind == '` + elemSet + `' then
+					register_set(e.key, e.registry)
+				end
+			end
+			redis.call('SADD', item.elem_list, e.kind .. e.elem .. ' ' .. e.key)
+		end
+		redis.call('SADD', KEYS[1], item.key)
+	end
+`
+
+// luaRemoveElems is a Lua function that removes an item from indices of its array elements
+// found with the item's auxiliary list (see write_item).
+// The indices aren't declared in KEYS: they are in the same slot of Redis Cluster as the item (see luaRemoveItem).
+const luaRemoveElems = `
+	local function remove_elems(key, elem_list)
+		for _, entry in ipairs(redis.call('SMEMBERS', elem_list)) do
+			local kind, elem, e = string.match(entry, '^(%a)(%d+) (.*)$')
+			local member = key .. ':' .. elem
+			if kind == '` + elemZSet + `' then
+				redis.call('ZREM', e, member)
+			else
+				redis.call('SREM', e, member)
+				if kind == '` + elemSet + `' then
+					unregister_set(e)
+				end
+			end
+		end
+	end
+`
+
+// luaRemoveItem is a Lua function that removes an item along with its secondary indices
+// (they are found with the item's auxiliary lists) and removes it from the set of all IDs passed as KEYS[1].
+// Keys of the stored indices are known only from the auxiliary lists, so they can't be declared in KEYS.
+// They are in the same slot of Redis Cluster as the declared keys, since all keys of an entity share its hash tag.
+const luaRemoveItem = luaRemoveElems + `
+	local function remove_item(key, set_list, zset_list, elem_list)
+		for _, s in ipairs(redis.call('SMEMBERS', set_list)) do
+			redis.call('SREM', s, key)
+			unregister_set(s)
+		end
+		for _, z in ipairs(redis.call('SMEMBERS', zset_list)) do
+			redis.call('ZREM', z, key)
+		end
+		remove_elems(key, elem_list)
+		redis.call('DEL', key, set_list, zset_list, elem_list)
+		redis.call('SREM', KEYS[1], key)
+	end
+`
+
+// luaCheckETag is a Lua snippet that checks that an item (KEYS[2]) exists and has the expected ETag (ARGV[1]).
+const luaCheckETag = `
+	local etag = redis.call('HGET', KEYS[2], '` + ETagField + `')
+	if not etag then
+		return redis.error_reply('` + errReplyNotFound + `')
+	end
+	if etag ~= ARGV[1] then
+		return redis.error_reply('` + errReplyConflict + `')
+	end
+`
+
+// insertScript atomically inserts items along with their secondary indices and marks the version of the keys layout.
+// If any of the items already exists nothing is written and CONFLICT error is returned.
+// KEYS: a set of all IDs, the keys version marker, then KEYS of every item as read by read_item.
+// ARGV: the prefix of registered set indices (empty if they aren't registered), the marker's value
+// (empty if it's not written), then ARGV of every item as read by read_item.
+var insertScript = redis.NewScript(luaRegistries + luaReadItem + luaWriteItem + `
+	registries = ARGV[1] ~= '' and ARGV[1]
+	local items, seen = {}, {}
+	local k, a = 3, 3
+	while a <= #ARGV do
+		local item
+		item, k, a = read_item(k, a)
+		-- The same ID may come twice in one batch as well
+		if seen[item.key] or redis.call('EXISTS', item.key) == 1 then
+			return redis.error_reply('` + errReplyConflict + `')
+		end
+		seen[item.key] = true
+		table.insert(items, item)
+	end
+
+	for _, item in ipairs(items) do
+		write_item(item)
+	end
+	if ARGV[2] ~= '' then
+		redis.call('SET', KEYS[2], ARGV[2])
+	end
+	return #items
+`)
+
+// updateScript atomically replaces an item if its stored ETag is the expected one.
+// Secondary indices of the stored item are replaced with the new ones.
+// Returns NOT_FOUND error if the item doesn't exist and CONFLICT error if its ETag differs.
+// KEYS: a set of all IDs, then KEYS of the item as read by read_item.
+// ARGV: the expected ETag, the prefix of registered set indices, then ARGV of the item as read by read_item.
+var updateScript = redis.NewScript(luaRegistries + luaReadItem + luaWriteItem + luaRemoveItem + luaCheckETag + `
+	registries = ARGV[2] ~= '' and ARGV[2]
+	local item = read_item(2, 3)
+	remove_item(item.key, item.set_list, item.zset_list, item.elem_list)
+	write_item(item)
+	return 1
+`)
+
+// deleteScript atomically deletes an item along with its secondary indices if its stored ETag is the expected one.
+// Returns NOT_FOUND error if the item doesn't exist and CONFLICT error if its ETag differs.
+// KEYS: a set of all IDs, the item's hash key, auxiliary lists of its set, zset and elements indices.
+// ARGV: the expected ETag, the prefix of registered set indices.
+var deleteScript = redis.NewScript(luaRegistries + luaRemoveItem + luaCheckETag + `
+	registries = ARGV[2] ~= '' and ARGV[2]
+	remove_item(KEYS[2], KEYS[3], KEYS[4], KEYS[5])
+	return 1
+`)
+
+// insertParams returns KEYS and ARGV for insertScript.
+func (im *ItemManager) insertParams(items []*resource.Item) (*luaParams, error) {
+	p := new(luaParams)
+	p.key(im.keys().allIDs())
+	p.key(im.keys().keysVersion())
+	p.arg(im.keys().registered())
+	p.arg(im.keysMarker())
+	for _, item := range items {
+		if err := im.bindItem(p, item); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// updateParams returns KEYS and ARGV for updateScript.
+func (im *ItemManager) updateParams(item, original *resource.Item) (*luaParams, error) {
+	p := new(luaParams)
+	p.key(im.keys().allIDs())
+	p.arg(original.ETag)
+	p.arg(im.keys().registered())
+	if err := im.bindItem(p, item); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// deleteParams returns KEYS and ARGV for deleteScript.
+func (im *ItemManager) deleteParams(item *resource.Item) *luaParams {
+	p := new(luaParams)
+	key := im.RedisItemKey(item)
+	p.key(im.keys().allIDs())
+	p.key(key)
+	p.key(auxIndexListKey(key, false))
+	p.key(auxIndexListKey(key, true))
+	p.key(auxElemListKey(key))
+	p.arg(item.ETag)
+	p.arg(im.keys().registered())
+	return p
+}
+
+// bindItem binds KEYS and ARGV of an item to be read by read_item.
+func (im *ItemManager) bindItem(p *luaParams, item *resource.Item) error {
+	key, value, err := im.NewRedisItem(item)
+	if err != nil {
+		return err
+	}
+	sets := im.setIndices(item)
+	zsets := im.IndexZSetKeys(item)
+	exists := im.ExistsSetKeys(item)
+	elems := im.elemIndices(item)
+	zsetKeys := make([]string, 0, len(zsets))
+	for k := range zsets {
+		zsetKeys = append(zsetKeys, k)
+	}
+	sort.Strings(zsetKeys)
+
+	p.key(key)
+	p.key(auxIndexListKey(key, false))
+	p.key(auxIndexListKey(key, true))
+	p.key(auxElemListKey(key))
+	for _, s := range sets {
+		p.key(s.key)
+	}
+	if im.KeyEncoding != PlainKeys {
+		for _, s := range sets {
+			p.key(s.registry)
+		}
+	}
+	for _, k := range zsetKeys {
+		p.key(k)
+	}
+	for _, k := range exists {
+		p.key(k)
+	}
+	for _, e := range elems {
+		p.key(e.key)
+		if e.registry != "" {
+			p.key(e.registry)
+		}
+	}
+
+	p.arg(len(value))
+	p.arg(len(sets))
+	p.arg(len(zsetKeys))
+	p.arg(len(exists))
+	p.arg(len(elems))
+	for _, f := range sortedFields(value) {
+		p.arg(f)
+		p.arg(value[f])
+	}
+	for _, k := range zsetKeys {
+		p.arg(zsets[k])
+	}
+	for _, e := range elems {
+		p.arg(e.kind)
+		p.arg(e.elem)
+		p.arg(e.score)
+	}
+	return nil
+}
+
+// scriptError converts error replies of the write scripts to rest-layer errors.
+func scriptError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// Some Redis versions prepend the generic error code to the reply
+	switch strings.TrimPrefix(err.Error(), "ERR ") {
+	case errReplyConflict:
+		return resource.ErrConflict
+	case errReplyNotFound:
+		return resource.ErrNotFound
+	}
+	return err
+}
+
+// sortedFields returns names of hash fields in a stable order.
+func sortedFields(value map[string]interface{}) []string {
+	fields := make([]string, 0, len(value))
+	for f := range value {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,40 @@
+package rds
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertParams_DeclaresRegistries(t *testing.T) {
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{
+		"name":     "Bob",
+		"comments": []interface{}{map[string]interface{}{"author": "Ann"}},
+	}}
+	im := &ItemManager{EntityName: "users", Layout: BlobLayout, Codec: GobCodec, Filterable: []string{"name", "comments"}}
+
+	p, err := im.insertParams([]*resource.Item{item})
+	assert.NoError(t, err)
+	assert.Equal(t, "users:set:", p.Args[0])
+	// registries of set indices follow them, sets of items having values aren't registered
+	assert.Equal(t, []string{
+		"users:ids", "users:keys_version",
+		"users:item:1", "users:item:1:secondary_idx_set_list", "users:item:1:secondary_idx_zset_list",
+		"users:item:1:secondary_idx_elem_list",
+		"users:set:name:Bob", "users:set:id:1", "users:set:name", "users:set:id",
+		"users:zset:updated",
+		"users:exists:name", "users:exists:comments",
+		"users:elems:comments", "users:set:comments.author:Ann", "users:set:comments.author",
+	}, p.Keys)
+
+	im.KeyEncoding = PlainKeys
+	p, err = im.insertParams([]*resource.Item{item})
+	assert.NoError(t, err)
+	assert.Equal(t, "", p.Args[0])
+	assert.Equal(t, []string{
+		"users:all_ids", "users:keys_version",
+		"users:1", "users:1:secondary_idx_set_list", "users:1:secondary_idx_zset_list", "users:1:secondary_idx_elem_list",
+		"users:name:Bob", "users:id:1", "users:updated",
+	}, p.Keys)
+}
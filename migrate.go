@@ -0,0 +1,166 @@
+package rds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/rest-layer/resource"
+)
+
+// MigrateKeys moves items stored with PlainKeys (e.g. by the earlier versions) to the keys of the handler's encoding.
+// Items are moved one by one along with their secondary indices: each one is inserted with the new keys
+// and then deleted with the old ones. So it can be run again if interrupted: already moved items are skipped.
+// Items are read as the earlier versions stored them (with BlobLayout and GobCodec), unless they are stored
+// with FieldsLayout. They are written with the handler's layout and codec.
+// With a tenant extractor only the items of the context's tenant are moved.
+// Returns the number of moved items.
+func (h *Handler) MigrateKeys(ctx context.Context) (int, error) {
+	moved := 0
+	err := handleWithContext(ctx, func() error {
+		// Keys are not checked: they are expected not to match
+		im, err := h.scopedItemManager(ctx)
+		if err != nil {
+			return err
+		}
+		if im.KeyEncoding == PlainKeys {
+			return errors.New("keys are already plain")
+		}
+		old := *im
+		old.KeyEncoding = PlainKeys
+		legacy := old
+		legacy.Layout, legacy.Codec = BlobLayout, GobCodec
+		legacy.FieldNames = BlobLayout.hashFields(im.Fields)
+		old.Layout = FieldsLayout
+		old.FieldNames = FieldsLayout.hashFields(im.Fields)
+
+		keys, err := h.client.SMembers(old.keys().allIDs()).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Only items stored with FieldsLayout have types of their fields
+			fields, err := h.client.HExists(key, typesField).Result()
+			if err != nil {
+				return err
+			}
+			stored := &legacy
+			if fields {
+				stored = &old
+			}
+			data, err := h.client.HMGet(key, stored.FieldNames...).Result()
+			if err != nil {
+				return err
+			}
+			item, err := stored.NewItem(key, data)
+			if err != nil {
+				return err
+			}
+
+			p, err := im.insertParams([]*resource.Item{item})
+			if err != nil {
+				return err
+			}
+			err = scriptError(insertScript.Run(h.client, p.Keys, p.Args...).Err())
+			if err == resource.ErrConflict {
+				// The item is already moved if the previous run was interrupted.
+				// Otherwise another item with the same ID was inserted with the new keys.
+				newKey := im.RedisItemKey(item)
+				etag, err := h.client.HGet(newKey, ETagField).Result()
+				if err != nil {
+					return err
+				}
+				if etag != item.ETag {
+					return fmt.Errorf("different items are stored with keys %q and %q", key, newKey)
+				}
+			} else if err != nil {
+				return err
+			}
+
+			p = old.deleteParams(item)
+			if err := scriptError(deleteScript.Run(h.client, p.Keys, p.Args...).Err()); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// KeysMismatchError is returned when the items of an entity are stored with another key encoding or layout
+// than the handler's ones, e.g. by the earlier versions.
+type KeysMismatchError struct {
+	// Prefix of the keys of the entity.
+	Prefix string
+	// Stored and Expected describe how the items are stored and how the handler expects them to be.
+	Stored, Expected string
+	hint             string
+}
+
+func (e *KeysMismatchError) Error() string {
+	return fmt.Sprintf("items of %q are stored with %s, not %s: %s", e.Prefix, e.Stored, e.Expected, e.hint)
+}
+
+// checkKeysScript reads the keys version marker and tells whether there are items stored with PlainKeys.
+// With PlainKeys the marker's key may be taken by an item, so only a string is taken for the marker.
+// KEYS: the keys version marker, a set of all IDs of PlainKeys.
+var checkKeysScript = redis.NewScript(`
+	local marker = false
+	if redis.call('TYPE', KEYS[1]).ok == 'string' then
+		marker = redis.call('GET', KEYS[1])
+	end
+	return {marker, redis.call('EXISTS', KEYS[2])}
+`)
+
+// keysMarker returns a value of the keys version marker: the version of the keys layout and the name of the layout.
+// The marker is written only with EscapedKeys, returns an empty string with PlainKeys.
+// Ex: 2:fields
+func (im *ItemManager) keysMarker() string {
+	if im.KeyEncoding == PlainKeys {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", im.KeyEncoding.version(), im.Layout.name())
+}
+
+// checkKeys makes sure that the items of an entity are stored with the item manager's key encoding and layout.
+// Once the marker written with the same ones (or no marker without items stored with PlainKeys) is seen,
+// the keyspace isn't checked again.
+// Layouts of the items stored with PlainKeys can't be checked: there is no marker for them.
+func (h *Handler) checkKeys(im *ItemManager) error {
+	ks := im.keys()
+	if _, ok := h.checkedKeys.Load(ks.prefix); ok {
+		return nil
+	}
+	escaped, plain := *im, *im
+	escaped.KeyEncoding, plain.KeyEncoding = EscapedKeys, PlainKeys
+	res, err := checkKeysScript.Run(h.client, []string{escaped.keys().keysVersion(), plain.keys().allIDs()}).Result()
+	if err != nil {
+		return err
+	}
+	values := res.([]interface{})
+	marker, _ := values[0].(string)
+	plainItems := values[1].(int64) == 1
+
+	switch {
+	case marker == "" && plainItems && im.KeyEncoding != PlainKeys:
+		return &KeysMismatchError{Prefix: ks.prefix, Stored: "plain keys", Expected: "escaped keys",
+			hint: "use WithKeyEncoding(PlainKeys) or move them with MigrateKeys"}
+	case marker == "":
+		// Nothing is stored yet or the items are stored with PlainKeys as expected
+	case im.KeyEncoding == PlainKeys:
+		return &KeysMismatchError{Prefix: ks.prefix, Stored: "escaped keys", Expected: "plain keys",
+			hint: "don't use WithKeyEncoding(PlainKeys)"}
+	case marker != im.keysMarker():
+		layout := marker[strings.Index(marker, ":")+1:]
+		return &KeysMismatchError{Prefix: ks.prefix, Stored: layout + " layout", Expected: im.Layout.name() + " layout",
+			hint: "use WithLayout accordingly"}
+	}
+	h.checkedKeys.Store(ks.prefix, true)
+	return nil
+}
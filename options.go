@@ -0,0 +1,188 @@
+package rds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// Option configures a Handler. Options are passed to NewHandler.
+type Option func(h *Handler) error
+
+// WithLayout sets the layout items are stored with. FieldsLayout is used by default.
+// Use BlobLayout to work with items stored by the earlier versions.
+func WithLayout(l Layout) Option {
+	return func(h *Handler) error {
+		if l != FieldsLayout && l != BlobLayout {
+			return fmt.Errorf("unknown layout: %d", l)
+		}
+		h.manager.Layout = l
+		return nil
+	}
+}
+
+// WithCodec sets the Codec payloads are encoded with. GobCodec is used by default.
+// Use JSONCodec or MsgpackCodec to make the stored items readable by other languages.
+func WithCodec(c Codec) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return errors.New("codec is nil")
+		}
+		h.manager.Codec = c
+		return nil
+	}
+}
+
+// WithHashTags makes all keys of the entity start with the hash tag of its name, e.g. '{users}:1234'.
+// This way they are stored in the same slot of Redis Cluster (or the same shard of redis.Ring),
+// so that scripts can use them together.
+// It's enabled by default for *redis.ClusterClient and *redis.Ring and can't be disabled for them.
+// Use it if a cluster is hidden behind another client (e.g. a proxy).
+// Keys of the items stored without hash tags are different, so they won't be found.
+func WithHashTags(enabled bool) Option {
+	return func(h *Handler) error {
+		h.manager.HashTags = enabled
+		return nil
+	}
+}
+
+// WithKeyEncoding sets how keys of items and their indices are built. EscapedKeys is used by default.
+// Use PlainKeys to work with items stored by the earlier versions.
+func WithKeyEncoding(e KeyEncoding) Option {
+	return func(h *Handler) error {
+		if e != EscapedKeys && e != PlainKeys {
+			return fmt.Errorf("unknown key encoding: %d", e)
+		}
+		h.manager.KeyEncoding = e
+		return nil
+	}
+}
+
+// WithNamespace stores all keys of the handler under the namespace, e.g. 'billing:users:1234' instead of 'users:1234'.
+// Use it to separate the same entities of several applications sharing a Redis database.
+// With hash tags the namespace is a part of the tag: '{billing:users}:1234'.
+func WithNamespace(namespace string) Option {
+	return func(h *Handler) error {
+		if namespace == "" {
+			return errors.New("namespace is empty")
+		}
+		h.manager.Namespace = namespace
+		return nil
+	}
+}
+
+// WithTenant scopes all keys of every request to the tenant returned by extract for the request's context,
+// e.g. 'acme:users:1234' or 'billing:acme:users:1234' with a namespace.
+// So the handler operates only on the data of the request's tenant.
+// Requests fail with the extractor's error or with ErrNoTenant if it returns an empty tenant.
+func WithTenant(extract func(ctx context.Context) (string, error)) Option {
+	return func(h *Handler) error {
+		if extract == nil {
+			return errors.New("tenant extractor is nil")
+		}
+		h.tenant = extract
+		return nil
+	}
+}
+
+// WithReplicas makes Find read from the clients connected to read replicas rather than from the primary client.
+// Replicas are picked in turn, a request falls back to the primary client if a replica fails.
+// Writes and queries that can't be run on replicas always use the primary client.
+// Use ReadFromPrimary to read from the primary client when the latest writes should be seen.
+func WithReplicas(clients ...redis.Cmdable) Option {
+	return func(h *Handler) error {
+		if len(clients) == 0 {
+			return errors.New("no replica clients")
+		}
+		for _, c := range clients {
+			if isNilClient(c) {
+				return errors.New("replica client is nil")
+			}
+		}
+		h.replicas = &replicaPool{clients: clients}
+		return nil
+	}
+}
+
+// WithRegexScanLimit sets how many values of a field a regex filter may be matched against, 10000 by default.
+// Values of a field are scanned on every query with a regex filter, queries fail with ErrRegexScanLimit
+// if the field has more of them.
+func WithRegexScanLimit(limit int) Option {
+	return func(h *Handler) error {
+		if limit <= 0 {
+			return fmt.Errorf("regex scan limit should be positive: %d", limit)
+		}
+		h.regexScanLimit = limit
+		return nil
+	}
+}
+
+// WithLenientDecoding makes Find skip items that can't be decoded instead of returning CorruptedItemError.
+// Keys of the skipped items are added to the quarantine set of the entity (e.g. 'users:quarantine')
+// and are reported to onCorrupted if it's not nil.
+func WithLenientDecoding(onCorrupted func(key string, err error)) Option {
+	return func(h *Handler) error {
+		h.lenient = true
+		h.onCorrupted = onCorrupted
+		return nil
+	}
+}
+
+// validate checks that the Handler is configured properly after all the options are applied.
+func (h *Handler) validate() error {
+	if isNilClient(h.client) {
+		return errors.New("redis client is nil")
+	}
+	// Scripts would fail with CROSSSLOT errors if keys of the entity were distributed among the nodes
+	if isSharded(h.client) && !h.manager.HashTags {
+		return fmt.Errorf("hash tags can't be disabled with %T", h.client)
+	}
+	if h.manager.EntityName == "" {
+		return errors.New("entity name is empty")
+	}
+	// Braces in a name would break the hash tag of the keys
+	if h.manager.HashTags && strings.ContainsAny(h.manager.EntityName, "{}") {
+		return fmt.Errorf("entity name %q can't contain braces with hash tags", h.manager.EntityName)
+	}
+	if h.manager.HashTags && strings.ContainsAny(h.manager.Namespace, "{}") {
+		return fmt.Errorf("namespace %q can't contain braces with hash tags", h.manager.Namespace)
+	}
+
+	name := h.manager.Codec.Name()
+	if name == "" {
+		return errors.New("codec name is empty")
+	}
+	// With FieldsLayout the codec's name is stored as a type of the encoded values,
+	// so it should not be mistaken for another type when they are read back.
+	if h.manager.Layout == FieldsLayout {
+		if isScalarType(name) {
+			return fmt.Errorf("codec name %q is reserved for values of scalar types", name)
+		}
+		if c, ok := codecs[name]; ok && c != h.manager.Codec {
+			return fmt.Errorf("codec name %q is reserved for the built-in codec", name)
+		}
+	}
+	return nil
+}
+
+// isSharded tells whether a client distributes keys among several servers (see WithHashTags).
+func isSharded(c redis.Cmdable) bool {
+	switch c.(type) {
+	case *redis.ClusterClient, *redis.Ring:
+		return true
+	}
+	return false
+}
+
+// isNilClient tells whether a client is nil, including a nil pointer of a client type (e.g. (*redis.Client)(nil)).
+func isNilClient(c redis.Cmdable) bool {
+	if c == nil {
+		return true
+	}
+	v := reflect.ValueOf(c)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
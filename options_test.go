@@ -0,0 +1,77 @@
+package rds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+type namedCodec struct {
+	rds.Codec
+	name string
+}
+
+func (c namedCodec) Name() string {
+	return c.name
+}
+
+func TestNewHandler_Options(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: redisAddress})
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{redisAddress}})
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"shard": redisAddress}})
+	cases := []struct {
+		client redis.Cmdable
+		entity string
+		opts   []rds.Option
+		valid  bool
+	}{
+		{client, "users", nil, true},
+		{client, "users", []rds.Option{rds.WithLayout(rds.BlobLayout), rds.WithCodec(rds.JSONCodec)}, true},
+		{client, "users", []rds.Option{rds.WithHashTags(true), rds.WithLenientDecoding(nil)}, true},
+		{client, "{users}", nil, true},
+		{client, "users", []rds.Option{rds.WithCodec(namedCodec{rds.JSONCodec, "custom"})}, true},
+		{client, "users", []rds.Option{rds.WithLayout(rds.BlobLayout), rds.WithCodec(namedCodec{rds.JSONCodec, "gob"})}, true},
+		{client, "users", []rds.Option{rds.WithNamespace("billing"), rds.WithHashTags(true)}, true},
+		{client, "users", []rds.Option{rds.WithKeyEncoding(rds.PlainKeys)}, true},
+		{client, "users", []rds.Option{rds.WithTenant(func(ctx context.Context) (string, error) { return "", nil })}, true},
+		{client, "users", []rds.Option{rds.WithReplicas(client, client)}, true},
+		{client, "users", []rds.Option{rds.WithRegexScanLimit(1)}, true},
+		{nil, "users", nil, false},
+		{(*redis.Client)(nil), "users", nil, false},
+		{cluster, "users", []rds.Option{rds.WithHashTags(false)}, false},
+		{ring, "users", []rds.Option{rds.WithHashTags(false)}, false},
+		{cluster, "users", nil, true},
+		{ring, "users", []rds.Option{rds.WithHashTags(true)}, true},
+		{client, "users", []rds.Option{rds.WithReplicas(client, (*redis.Client)(nil))}, false},
+		{client, "", nil, false},
+		{client, "{users}", []rds.Option{rds.WithHashTags(true)}, false},
+		{client, "users", []rds.Option{rds.WithNamespace("")}, false},
+		{client, "users", []rds.Option{rds.WithTenant(nil)}, false},
+		{client, "users", []rds.Option{rds.WithReplicas()}, false},
+		{client, "users", []rds.Option{rds.WithRegexScanLimit(0)}, false},
+		{client, "users", []rds.Option{rds.WithReplicas(client, nil)}, false},
+		{client, "users", []rds.Option{rds.WithNamespace("{billing}"), rds.WithHashTags(true)}, false},
+		{client, "users", []rds.Option{rds.WithLayout(rds.Layout(42))}, false},
+		{client, "users", []rds.Option{rds.WithKeyEncoding(rds.KeyEncoding(42))}, false},
+		{client, "users", []rds.Option{rds.WithCodec(nil)}, false},
+		{client, "users", []rds.Option{rds.WithCodec(namedCodec{rds.JSONCodec, ""})}, false},
+		{client, "users", []rds.Option{rds.WithCodec(namedCodec{rds.JSONCodec, "string"})}, false},
+		{client, "users", []rds.Option{rds.WithCodec(namedCodec{rds.JSONCodec, "gob"})}, false},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		h, err := rds.NewHandler(tc.client, tc.entity, userSchema, tc.opts...)
+		if tc.valid {
+			assert.NoError(t, err, msg)
+			assert.NotNil(t, h, msg)
+		} else {
+			assert.Error(t, err, msg)
+			assert.Nil(t, h, msg)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package rds
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/rs/rest-layer/resource"
 	"github.com/rs/rest-layer/schema/query"
@@ -11,7 +12,8 @@ import (
 // normalizePredicate turns implicit AND on list of params of rest-layer query into an explicit AND-predicate
 func normalizePredicate(predicate query.Predicate) query.Predicate {
 	if len(predicate) > 1 {
-		return query.Predicate{&query.And{predicate}}
+		and := query.And(predicate)
+		return query.Predicate{&and}
 	}
 	return predicate
 }
@@ -19,39 +21,45 @@ func normalizePredicate(predicate query.Predicate) query.Predicate {
 // translatePredicate interprets rest-layer query to a Lua query script to be fed to Redis.
 // This results in a Lua query that ultimately creates a Redis sorted-set with the IDs of the items corresponding
 // to the initial query. Also you get a key in which this set is stored and a list a temporary keys
-// you should delete later
+// you should delete later.
+// Neither keys nor query values are written into the script text: they are bound to params and the script
+// refers to them as KEYS[n] and ARGV[n]. So all the returned keys are Lua expressions as well.
 // Return: lastKeyWhereResultCanBeFound, luaQuery, allCreatedKeys, error
-func translatePredicate(entityName string, predicate query.Predicate) (string, string, []string, error) {
+func translatePredicate(p *luaParams, ks keyspace, predicate query.Predicate) (string, string, []string, error) {
 	var tempKeys []string
 	newKey := func() string {
-		k := tmpVar()
+		k := p.key(ks.tmp())
 		tempKeys = append(tempKeys, k)
 		return k
 	}
 
 	// If no predicate given (we need all existing items to be retrieved) - use the set of all IDs as a source
 	if len(predicate) == 0 {
-		return sKeyIDsAll(entityName), "", tempKeys, nil
+		return p.key(ks.allIDs()), "", tempKeys, nil
 	}
 
 	for _, exp := range predicate {
+		if !comparable(ks, exp) {
+			return "", "", nil, resource.ErrNotImplemented
+		}
 		switch t := exp.(type) {
 		case *query.And:
 			var subs, keys []string
 			var key string
 			for _, subExp := range *t {
-				k, res, _, err := translatePredicate(entityName, query.Predicate{subExp})
+				k, res, subKeys, err := translatePredicate(p, ks, query.Predicate{subExp})
 				if err != nil {
 					return "", "", nil, err
 				}
+				tempKeys = append(tempKeys, subKeys...)
 				keys = append(keys, k)
 				subs = append(subs, res)
 			}
 			if len(keys) > 1 {
 				key = newKey()
 				andClause := fmt.Sprintf(
-					"redis.call('ZINTERSTORE', '%[1]s', unpack(%[2]s))",
-					key, makeLuaTableFromStrings(keys))
+					"redis.call('ZINTERSTORE', %[1]s, %[2]d, unpack(%[3]s))\n%[4]s",
+					key, len(keys), makeLuaTable(keys), expire(key))
 				subs = append(subs, andClause)
 			} else {
 				// Nothing to intersect here - we have only one Set(ZSet)
@@ -62,18 +70,19 @@ func translatePredicate(entityName string, predicate query.Predicate) (string, s
 			var subs, keys []string
 			var key string
 			for _, subExp := range *t {
-				k, res, _, err := translatePredicate(entityName, query.Predicate{subExp})
+				k, res, subKeys, err := translatePredicate(p, ks, query.Predicate{subExp})
 				if err != nil {
 					return "", "", nil, err
 				}
+				tempKeys = append(tempKeys, subKeys...)
 				keys = append(keys, k)
 				subs = append(subs, res)
 			}
 			if len(keys) > 1 {
 				key = newKey()
 				orClause := fmt.Sprintf(
-					"redis.call('ZUNIONSTORE', '%[1]s', unpack(%[2]s))",
-					key, makeLuaTableFromStrings(keys))
+					"redis.call('ZUNIONSTORE', %[1]s, %[2]d, unpack(%[3]s))\n%[4]s",
+					key, len(keys), makeLuaTable(keys), expire(key))
 				subs = append(subs, orClause)
 			} else {
 				// Nothing to union here - we have only one Set(ZSet)
@@ -81,149 +90,173 @@ func translatePredicate(entityName string, predicate query.Predicate) (string, s
 			}
 			return key, strings.Join(subs, "\n"), tempKeys, nil
 		case *query.In:
-			key1 := newKey()
-			key2 := newKey()
-			key3 := newKey()
-			var1 := tmpVar()
-			var2 := tmpVar()
-
-			if isNumeric(t.Values...) {
+			if numeric(ks, t.Field, t.Values...) {
+				key := newKey()
 				result := fmt.Sprintf(`
-				local %[1]s = %[2]s
-				for x = %[1]s do
-					local ys = redis.call('ZRANGEBYSCORE', '%[3]s', x, x)
+				for _, x in ipairs(%[1]s) do
+					local ys = redis.call('ZRANGEBYSCORE', %[2]s, x, x)
 					if next(ys) ~= nil then
-						redis.call('SADD', '%[4]s', unpack(ys))
+						redis.call('SADD', %[3]s, unpack(ys))
+						%[4]s
 					end
 				end
-				`, var1, makeLuaTableFromValues(t.Values), zKey(entityName, t.Field), key1)
-				return key1, result, tempKeys, nil
+				`, p.argsTable(scores(t.Values)), p.key(ks.zset(t.Field)), key, expire(key))
+				return key, result, tempKeys, nil
 			}
-			var inKeys []string
-			for _, v := range t.Values {
-				inKeys = append(inKeys, sKey(entityName, t.Field, v))
-			}
-			// todo: we don't need local local %[1]s = %[2]s - just inline!
-			result := fmt.Sprintf(`
-				local %[1]s = %[2]s
+			key := newKey()
+			sets, result := existingSets(p, ks, t.Field, t.Values)
+			result += fmt.Sprintf(`
 				if next(%[1]s) ~= nil then
-					redis.call('SADD', '%[3]s', unpack(%[1]s))
+					redis.call('SUNIONSTORE', %[2]s, unpack(%[1]s))
+					%[3]s
 				end
-				local %[4]s = redis.call('KEYS', '%[5]s')
-				if next(%[4]s) ~= nil then
-					redis.call('SADD', '%[6]s', unpack(%[4]s))
-				end
-				redis.call('SINTERSTORE', '%[7]s', '%[3]s', '%[6]s')
-				`, var1, makeLuaTableFromStrings(inKeys), key1, var2, sKeyLastAll(entityName, t.Field), key2, key3)
-			return key3, result, tempKeys, nil
+				`, sets, key, expire(key))
+			return key, result, tempKeys, nil
 		case *query.NotIn:
-			key1 := newKey()
-			key2 := newKey()
-			key3 := newKey()
-
-			if isNumeric(t.Values) {
-				pairs, err := getRangeNumericPairs(t.Values)
-				if err != nil {
-					return "", "", nil, err
-				}
+			if numeric(ks, t.Field, t.Values...) {
+				key := newKey()
 				result := fmt.Sprintf(`
-				for x = %[1]s do
-					local ys = redis.call('ZRANGEBYSCORE', '%[2]s', '(' .. x[1], '(' .. x[2])
-					if next(ys) ~= nil then
-						redis.call('SADD', '%[3]s', unpack(ys))
-					end
+				redis.call('ZUNIONSTORE', %[1]s, 1, %[2]s)
+				%[4]s
+				for _, x in ipairs(%[3]s) do
+					redis.call('ZREMRANGEBYSCORE', %[1]s, x, x)
 				end
-				`, makeLuaTableFromStrings(pairs), zKey(entityName, t.Field), key1)
-				return key1, result, tempKeys, nil
+				`, key, p.key(ks.zset(t.Field)), p.argsTable(scores(t.Values)), expire(key))
+				return key, result, tempKeys, nil
 			}
-			var inKeys []string
-			var1 := tmpVar()
-			var2 := tmpVar()
-			for _, v := range t.Values {
-				inKeys = append(inKeys, sKey(entityName, t.Field, v))
-			}
-			// todo: we don't need local local %[1]s = %[2]s - just inline!
-			result := fmt.Sprintf(`
-				local %[1]s = %[2]s
-				if next(%[1]s) ~= nil then
-					redis.call('SADD', '%[3]s', unpack(%[1]s))
-				end
-				local %[4]s = redis.call('KEYS', '%[5]s')
-				if next(%[1]s) ~= nil then
-					redis.call('SADD', '%[6]s', unpack(%[4]s))
-				end
-				redis.call('SDIFFSTORE', '%[7]s', '%[6]s', '%[3]s')
-				`, var1, makeLuaTableFromStrings(inKeys), key1, var2, sKeyLastAll(entityName, t.Field), key2, key3)
-			return key3, result, tempKeys, nil
+			key := newKey()
+			sets, result := existingSets(p, ks, t.Field, t.Values)
+			result += fmt.Sprintf(`
+				redis.call('SDIFFSTORE', %[1]s, %[2]s, unpack(%[3]s))
+				%[4]s
+				`, key, p.key(ks.allIDs()), sets, expire(key))
+			return key, result, tempKeys, nil
 		case *query.Equal:
 			var result string
 			key := newKey()
-			if isNumeric(t.Value) {
+			if numeric(ks, t.Field, t.Value) {
+				score := p.arg(valueToFloat(t.Value))
 				result = fmt.Sprintf(`
-				local %[5]s = redis.call('ZRANGEBYSCORE', '%[2]s', %[3]v, %[4]v)
-				if next(%[5]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[5]s))
+				local %[4]s = redis.call('ZRANGEBYSCORE', %[2]s, %[3]s, %[3]s)
+				if next(%[4]s) ~= nil then
+					redis.call('SADD', %[1]s, unpack(%[4]s))
+					%[5]s
 				end
-				`, key, zKey(entityName, t.Field), t.Value, t.Value, tmpVar())
+				`, key, p.key(ks.zset(t.Field)), score, p.newVar(), expire(key))
 			} else {
 				result = fmt.Sprintf(`
-				local %[3]s = redis.call('SMEMBERS', '%[2]s')
+				local %[3]s = redis.call('SMEMBERS', %[2]s)
 				if next(%[3]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[3]s))
+					redis.call('SADD', %[1]s, unpack(%[3]s))
+					%[4]s
 				end
-				`, key, sKey(entityName, t.Field, t.Value), tmpVar())
+				`, key, p.key(ks.set(t.Field, t.Value)), p.newVar(), expire(key))
 			}
 			return key, result, tempKeys, nil
 		case *query.NotEqual:
 			var result string
 			key := newKey()
-			if isNumeric(t.Value) {
+			if numeric(ks, t.Field, t.Value) {
+				score := p.arg(valueToFloat(t.Value))
 				result = fmt.Sprintf(`
-				redis.call('ZUNIONSTORE', '%s', 1, '%s')
-				redis.call('ZREMRANGEBYSCORE', '%s', %v, %v)
-				`, key, zKey(entityName, t.Field), key, t.Value, t.Value)
+				redis.call('ZUNIONSTORE', %[1]s, 1, %[2]s)
+				%[4]s
+				redis.call('ZREMRANGEBYSCORE', %[1]s, %[3]s, %[3]s)
+				`, key, p.key(ks.zset(t.Field)), score, expire(key))
 			} else {
 				result = fmt.Sprintf(`
-				 redis.call('SDIFFSTORE', '%s', '%s', '%s')
-				`, key, sKeyIDsAll(entityName), sKey(entityName, t.Field, t.Value))
+				redis.call('SDIFFSTORE', %s, %s, %s)
+				%s
+				`, key, p.key(ks.allIDs()), p.key(ks.set(t.Field, t.Value)), expire(key))
 			}
 			return key, result, tempKeys, nil
 		case *query.GreaterThan:
 			key := newKey()
 			result := fmt.Sprintf(`
-				local %[4]s = redis.call('ZRANGEBYSCORE', '%[2]s', '(%[3]f', '+inf')
+				local %[4]s = redis.call('ZRANGEBYSCORE', %[2]s, '(' .. %[3]s, '+inf')
 				if next(%[4]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[4]s))
+					redis.call('SADD', %[1]s, unpack(%[4]s))
+					%[5]s
 				end
-				`, key, zKey(entityName, t.Field), t.Value, tmpVar())
+				`, key, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value)), p.newVar(), expire(key))
 			return key, result, tempKeys, nil
 		case *query.GreaterOrEqual:
 			key := newKey()
 			result := fmt.Sprintf(`
-				local %[4]s = redis.call('ZRANGEBYSCORE', '%[2]s', %[3]f, '+inf')
+				local %[4]s = redis.call('ZRANGEBYSCORE', %[2]s, %[3]s, '+inf')
 				if next(%[4]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[4]s))
+					redis.call('SADD', %[1]s, unpack(%[4]s))
+					%[5]s
 				end
-				`, key, zKey(entityName, t.Field), t.Value, tmpVar())
+				`, key, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value)), p.newVar(), expire(key))
 			return key, result, tempKeys, nil
 		case *query.LowerThan:
 			key := newKey()
 			result := fmt.Sprintf(`
-				local %[4]s = redis.call('ZRANGEBYSCORE', '%[2]s', '-inf', '(%[3]f')
+				local %[4]s = redis.call('ZRANGEBYSCORE', %[2]s, '-inf', '(' .. %[3]s)
 				if next(%[4]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[4]s))
+					redis.call('SADD', %[1]s, unpack(%[4]s))
+					%[5]s
 				end
-				`, key, zKey(entityName, t.Field), t.Value, tmpVar())
+				`, key, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value)), p.newVar(), expire(key))
 			return key, result, tempKeys, nil
 		case *query.LowerOrEqual:
 			key := newKey()
-			tempKeys = append(tempKeys, key)
 			result := fmt.Sprintf(`
-				local %[4]s = redis.call('ZRANGEBYSCORE', '%[2]s', '-inf', %[3]f)
+				local %[4]s = redis.call('ZRANGEBYSCORE', %[2]s, '-inf', %[3]s)
 				if next(%[4]s) ~= nil then
-					redis.call('SADD', '%[1]s', unpack(%[4]s))
+					redis.call('SADD', %[1]s, unpack(%[4]s))
+					%[5]s
+				end
+				`, key, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value)), p.newVar(), expire(key))
+			return key, result, tempKeys, nil
+		case *query.ElemMatch:
+			eks, ok := ks.elements(t.Field)
+			if !ok {
+				return "", "", nil, resource.ErrNotImplemented
+			}
+			// Elements are matched in their own keyspace, so that all the expressions apply to the same element.
+			elems, sub, subKeys, err := translatePredicate(p, eks, normalizePredicate(query.Predicate(t.Exps)))
+			if err != nil {
+				return "", "", nil, err
+			}
+			tempKeys = append(tempKeys, subKeys...)
+			key := newKey()
+			result := sub + fmt.Sprintf(`
+				local %[3]s
+				if redis.call('TYPE', %[2]s).ok == 'zset' then
+					%[3]s = redis.call('ZRANGE', %[2]s, 0, -1)
+				else
+					%[3]s = redis.call('SMEMBERS', %[2]s)
+				end
+				-- Members are keys of items followed by positions of the elements
+				for _, m in ipairs(%[3]s) do
+					redis.call('SADD', %[1]s, string.match(m, '^(.*):%%d+$'))
+					%[4]s
 				end
-				`, key, zKey(entityName, t.Field), t.Value, tmpVar())
+				`, key, elems, p.newVar(), expire(key))
+			return key, result, tempKeys, nil
+		case *query.Exist:
+			exists := ks.exists(t.Field)
+			if exists == "" {
+				return "", "", nil, resource.ErrNotImplemented
+			}
+			key := newKey()
+			result := fmt.Sprintf(`
+				redis.call('SUNIONSTORE', %s, %s)
+				%s
+				`, key, p.key(exists), expire(key))
+			return key, result, tempKeys, nil
+		case *query.NotExist:
+			exists := ks.exists(t.Field)
+			if exists == "" {
+				return "", "", nil, resource.ErrNotImplemented
+			}
+			key := newKey()
+			result := fmt.Sprintf(`
+				redis.call('SDIFFSTORE', %s, %s, %s)
+				%s
+				`, key, p.key(ks.allIDs()), p.key(exists), expire(key))
 			return key, result, tempKeys, nil
 		default:
 			return "", "", nil, resource.ErrNotImplemented
@@ -231,3 +264,67 @@ func translatePredicate(entityName string, predicate query.Predicate) (string, s
 	}
 	return "", "", tempKeys, nil
 }
+
+// expire returns a Lua snippet that makes a temporary key expire soon after the script that created it,
+// so that it doesn't stay forever if the script fails before deleting it. It follows every command that stores the key:
+// the key never exists without the expiry even if the script fails right after the command.
+func expire(key string) string {
+	return fmt.Sprintf("redis.call('PEXPIRE', %s, %d)", key, tempKeyTTL/time.Millisecond)
+}
+
+// numeric tells whether values of a field are matched with its sorted set index.
+// Elements of arrays are indexed in sets by their values, so they are matched as strings even if they are numbers.
+func numeric(ks keyspace, field string, values ...query.Value) bool {
+	return isNumeric(values...) && !ks.isArray(field)
+}
+
+// comparable tells whether an expression can be evaluated with the indices of its field.
+// Elements of arrays are not indexed in sorted sets, so they can't be compared by ranges.
+func comparable(ks keyspace, exp query.Expression) bool {
+	switch t := exp.(type) {
+	case *query.GreaterThan:
+		return !ks.isArray(t.Field)
+	case *query.GreaterOrEqual:
+		return !ks.isArray(t.Field)
+	case *query.LowerThan:
+		return !ks.isArray(t.Field)
+	case *query.LowerOrEqual:
+		return !ks.isArray(t.Field)
+	}
+	return true
+}
+
+// existingSets returns a Lua snippet that collects keys of the existing set indices of the field's values
+// into a Lua table and a name of the variable holding it.
+// With EscapedKeys the keys are checked against the field's registry, so that missing values are skipped
+// without touching their keys. Otherwise all the keys are collected: missing sets are treated as empty ones anyway.
+func existingSets(p *luaParams, ks keyspace, field string, values []query.Value) (string, string) {
+	var keys []string
+	for _, v := range values {
+		keys = append(keys, ks.set(field, v))
+	}
+	sets := p.newVar()
+	registry := ks.registry(field)
+	if registry == "" {
+		return sets, fmt.Sprintf(`
+				local %[1]s = %[2]s
+				`, sets, p.keysTable(keys))
+	}
+	return sets, fmt.Sprintf(`
+				local %[1]s = {}
+				for _, s in ipairs(%[2]s) do
+					if redis.call('SISMEMBER', %[3]s, s) == 1 then
+						table.insert(%[1]s, s)
+					end
+				end
+				`, sets, p.keysTable(keys), p.key(registry))
+}
+
+// scores converts numeric query values into scores they are indexed with in a Redis sorted set.
+func scores(values []query.Value) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		result = append(result, valueToFloat(v))
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package rds
+
+import (
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// luaIDLists are Lua functions that combine lists of IDs held in Lua tables.
+const luaIDLists = `
+	local function inter_ids(lists)
+		local result = lists[1] or {}
+		for i = 2, #lists do
+			local present = {}
+			for _, id in ipairs(lists[i]) do
+				present[id] = true
+			end
+			local kept = {}
+			for _, id in ipairs(result) do
+				if present[id] then
+					table.insert(kept, id)
+				end
+			end
+			result = kept
+		end
+		return result
+	end
+	-- Members of sets come in no particular order, so they are sorted to keep results stable
+	local function set_ids(ids)
+		table.sort(ids)
+		return ids
+	end
+	local function union_ids(lists)
+		local result, seen = {}, {}
+		for _, ids in ipairs(lists) do
+			for _, id in ipairs(ids) do
+				if not seen[id] then
+					seen[id] = true
+					table.insert(result, id)
+				end
+			end
+		end
+		return result
+	end
+	-- Members of indices of array elements are keys of items followed by positions of the elements
+	local function element_items(elems)
+		local result, seen = {}, {}
+		for _, m in ipairs(elems) do
+			local id = string.match(m, '^(.*):%d+$')
+			if not seen[id] then
+				seen[id] = true
+				table.insert(result, id)
+			end
+		end
+		return set_ids(result)
+	end
+`
+
+// isReadOnly tells whether a predicate can be translated by translatePredicateReadOnly.
+func isReadOnly(predicate query.Predicate) bool {
+	for _, exp := range predicate {
+		switch t := exp.(type) {
+		case *query.And:
+			if !isReadOnly(query.Predicate(*t)) {
+				return false
+			}
+		case *query.Or:
+			if !isReadOnly(query.Predicate(*t)) {
+				return false
+			}
+		case *query.ElemMatch:
+			if !isReadOnly(query.Predicate(t.Exps)) {
+				return false
+			}
+		case *query.In, *query.NotIn, *query.Equal, *query.NotEqual,
+			*query.GreaterThan, *query.GreaterOrEqual, *query.LowerThan, *query.LowerOrEqual,
+			*query.Exist, *query.NotExist:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// translatePredicateReadOnly interprets rest-layer query to a Lua query script that writes nothing to Redis.
+// Unlike translatePredicate it collects IDs of the found items into Lua tables with the commands that don't store
+// their results (SMEMBERS, SUNION, SDIFF, ZRANGEBYSCORE) and intersects and unites them in Lua.
+// So the script can be run on read replicas and leaves no temporary keys behind.
+// The script relies on the functions of luaIDLists.
+// Return: luaVariableWhereResultCanBeFound, luaQuery, error
+func translatePredicateReadOnly(p *luaParams, ks keyspace, predicate query.Predicate) (string, string, error) {
+	ids := p.newVar()
+
+	// If no predicate given (we need all existing items to be retrieved) - use the set of all IDs as a source
+	if len(predicate) == 0 {
+		return ids, fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SMEMBERS', %[2]s))
+				`, ids, p.key(ks.allIDs())), nil
+	}
+
+	for _, exp := range predicate {
+		if !comparable(ks, exp) {
+			return "", "", resource.ErrNotImplemented
+		}
+		switch t := exp.(type) {
+		case *query.And:
+			subs, lists, err := translateSubPredicatesReadOnly(p, ks, *t)
+			if err != nil {
+				return "", "", err
+			}
+			return ids, subs + fmt.Sprintf(`
+				local %[1]s = inter_ids(%[2]s)
+				`, ids, makeLuaTable(lists)), nil
+		case *query.Or:
+			subs, lists, err := translateSubPredicatesReadOnly(p, ks, *t)
+			if err != nil {
+				return "", "", err
+			}
+			return ids, subs + fmt.Sprintf(`
+				local %[1]s = union_ids(%[2]s)
+				`, ids, makeLuaTable(lists)), nil
+		case *query.In:
+			if numeric(ks, t.Field, t.Values...) {
+				// The same value may be given more than once
+				return ids, fmt.Sprintf(`
+				local %[1]s
+				do
+					local lists = {}
+					for _, x in ipairs(%[2]s) do
+						table.insert(lists, redis.call('ZRANGEBYSCORE', %[3]s, x, x))
+					end
+					%[1]s = union_ids(lists)
+				end
+				`, ids, p.argsTable(scores(t.Values)), p.key(ks.zset(t.Field))), nil
+			}
+			sets, result := existingSets(p, ks, t.Field, t.Values)
+			return ids, result + fmt.Sprintf(`
+				local %[1]s = {}
+				if next(%[2]s) ~= nil then
+					%[1]s = set_ids(redis.call('SUNION', unpack(%[2]s)))
+				end
+				`, ids, sets), nil
+		case *query.NotIn:
+			if numeric(ks, t.Field, t.Values...) {
+				return ids, fmt.Sprintf(`
+				local %[1]s = {}
+				do
+					local excluded = {}
+					for _, x in ipairs(%[2]s) do
+						excluded[tonumber(x)] = true
+					end
+					local ys = redis.call('ZRANGE', %[3]s, 0, -1, 'WITHSCORES')
+					for i = 1, #ys, 2 do
+						if not excluded[tonumber(ys[i + 1])] then
+							table.insert(%[1]s, ys[i])
+						end
+					end
+				end
+				`, ids, p.argsTable(scores(t.Values)), p.key(ks.zset(t.Field))), nil
+			}
+			sets, result := existingSets(p, ks, t.Field, t.Values)
+			return ids, result + fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SDIFF', %[2]s, unpack(%[3]s)))
+				`, ids, p.key(ks.allIDs()), sets), nil
+		case *query.Equal:
+			if numeric(ks, t.Field, t.Value) {
+				return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, %[3]s, %[3]s)
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+			}
+			return ids, fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SMEMBERS', %[2]s))
+				`, ids, p.key(ks.set(t.Field, t.Value))), nil
+		case *query.NotEqual:
+			if numeric(ks, t.Field, t.Value) {
+				return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, '-inf', '(' .. %[3]s)
+				for _, id in ipairs(redis.call('ZRANGEBYSCORE', %[2]s, '(' .. %[3]s, '+inf')) do
+					table.insert(%[1]s, id)
+				end
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+			}
+			return ids, fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SDIFF', %[2]s, %[3]s))
+				`, ids, p.key(ks.allIDs()), p.key(ks.set(t.Field, t.Value))), nil
+		case *query.GreaterThan:
+			return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, '(' .. %[3]s, '+inf')
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+		case *query.GreaterOrEqual:
+			return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, %[3]s, '+inf')
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+		case *query.LowerThan:
+			return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, '-inf', '(' .. %[3]s)
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+		case *query.LowerOrEqual:
+			return ids, fmt.Sprintf(`
+				local %[1]s = redis.call('ZRANGEBYSCORE', %[2]s, '-inf', %[3]s)
+				`, ids, p.key(ks.zset(t.Field)), p.arg(valueToFloat(t.Value))), nil
+		case *query.ElemMatch:
+			eks, ok := ks.elements(t.Field)
+			if !ok {
+				return "", "", resource.ErrNotImplemented
+			}
+			// Elements are matched in their own keyspace, so that all the expressions apply to the same element.
+			elems, sub, err := translatePredicateReadOnly(p, eks, normalizePredicate(query.Predicate(t.Exps)))
+			if err != nil {
+				return "", "", err
+			}
+			return ids, sub + fmt.Sprintf(`
+				local %[1]s = element_items(%[2]s)
+				`, ids, elems), nil
+		case *query.Exist:
+			exists := ks.exists(t.Field)
+			if exists == "" {
+				return "", "", resource.ErrNotImplemented
+			}
+			return ids, fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SMEMBERS', %[2]s))
+				`, ids, p.key(exists)), nil
+		case *query.NotExist:
+			exists := ks.exists(t.Field)
+			if exists == "" {
+				return "", "", resource.ErrNotImplemented
+			}
+			return ids, fmt.Sprintf(`
+				local %[1]s = set_ids(redis.call('SDIFF', %[2]s, %[3]s))
+				`, ids, p.key(ks.allIDs()), p.key(exists)), nil
+		default:
+			return "", "", resource.ErrNotImplemented
+		}
+	}
+	return ids, "", nil
+}
+
+// translateSubPredicatesReadOnly translates each of the expressions of And/Or with translatePredicateReadOnly.
+// Returns the joined scripts and the variables holding results of each of them.
+func translateSubPredicatesReadOnly(p *luaParams, ks keyspace, exps []query.Expression) (string, []string, error) {
+	var script string
+	var lists []string
+	for _, subExp := range exps {
+		ids, res, err := translatePredicateReadOnly(p, ks, query.Predicate{subExp})
+		if err != nil {
+			return "", nil, err
+		}
+		script += res
+		lists = append(lists, ids)
+	}
+	return script, lists, nil
+}
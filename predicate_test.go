@@ -0,0 +1,189 @@
+package rds
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslatePredicate_SameScriptForSameShape(t *testing.T) {
+	cases := []struct {
+		a, b query.Predicate
+	}{
+		{
+			query.Predicate{&query.Equal{Field: "name", Value: "Bob"}},
+			query.Predicate{&query.Equal{Field: "name", Value: "') redis.call('FLUSHALL') --"}},
+		},
+		{
+			query.Predicate{&query.Equal{Field: "age", Value: 19}},
+			query.Predicate{&query.Equal{Field: "age", Value: 77.5}},
+		},
+		{
+			query.Predicate{&query.In{Field: "age", Values: []query.Value{1, 2}}},
+			query.Predicate{&query.In{Field: "age", Values: []query.Value{3, 4}}},
+		},
+		{
+			query.Predicate{&query.NotIn{Field: "name", Values: []query.Value{"a", "b"}}},
+			query.Predicate{&query.NotIn{Field: "name", Values: []query.Value{"c", "d"}}},
+		},
+		{
+			query.Predicate{&query.In{Field: "age", Values: []query.Value{1, 2}}},
+			query.Predicate{&query.In{Field: "age", Values: []query.Value{3, 4, 5, 6, 7}}},
+		},
+		{
+			query.Predicate{&query.In{Field: "name", Values: []query.Value{"a"}}, &query.Equal{Field: "age", Value: 1}},
+			query.Predicate{&query.In{Field: "name", Values: []query.Value{"b", "c", "d"}}, &query.Equal{Field: "age", Value: 2}},
+		},
+		{
+			normalizePredicate(query.Predicate{
+				&query.GreaterThan{Field: "age", Value: 10},
+				&query.Or{&query.Equal{Field: "name", Value: "Bob"}, &query.LowerOrEqual{Field: "height", Value: 1.5}},
+			}),
+			normalizePredicate(query.Predicate{
+				&query.GreaterThan{Field: "age", Value: 20},
+				&query.Or{&query.Equal{Field: "name", Value: "Linda"}, &query.LowerOrEqual{Field: "height", Value: 2.5}},
+			}),
+		},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		pa, pb := new(luaParams), new(luaParams)
+		_, scriptA, _, err := translatePredicate(pa, keyspace{prefix: "users"}, tc.a)
+		assert.NoError(t, err, msg)
+		_, scriptB, _, err := translatePredicate(pb, keyspace{prefix: "users"}, tc.b)
+		assert.NoError(t, err, msg)
+		assert.Equal(t, scriptA, scriptB, msg)
+		assert.NotEmpty(t, scriptA, msg)
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	cases := []struct {
+		predicate query.Predicate
+		want      bool
+	}{
+		{nil, true},
+		{query.Predicate{&query.Equal{Field: "name", Value: "Bob"}}, true},
+		{query.Predicate{&query.And{&query.In{Field: "age", Values: []query.Value{1}}, &query.NotEqual{Field: "name", Value: "Bob"}}}, true},
+		{query.Predicate{&query.Or{&query.Equal{Field: "name", Value: "Bob"}, &query.Or{&query.LowerThan{Field: "age", Value: 3}}}}, true},
+		{query.Predicate{&query.Exist{Field: "name"}, &query.NotExist{Field: "age"}}, true},
+		{query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{&query.Equal{Field: "author", Value: "Bob"}}}}, true},
+		// regexes inside ElemMatch are resolved to In filters as well as the top-level ones
+		{query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{&query.In{Field: "author", Values: []query.Value{"Bob"}}}}}, true},
+		{query.Predicate{&query.Regex{Field: "name"}}, false},
+		{query.Predicate{&query.Or{&query.Equal{Field: "name", Value: "Bob"}, &query.Regex{Field: "name"}}}, false},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, isReadOnly(tc.predicate), fmt.Sprintf("Test case #%d", i))
+	}
+}
+
+func TestLuaQuery_ReadOnlyWritesNothing(t *testing.T) {
+	writes := regexp.MustCompile(`(?i)'(SADD|SREM|ZADD|ZREM|DEL|SET|EXPIRE)'|STORE'`)
+	predicates := []query.Predicate{
+		nil,
+		{&query.Equal{Field: "name", Value: "Bob"}},
+		{&query.NotEqual{Field: "age", Value: 7}},
+		{&query.In{Field: "name", Values: []query.Value{"Bob", "Linda"}}},
+		{&query.NotIn{Field: "age", Values: []query.Value{1, 2}}},
+		normalizePredicate(query.Predicate{
+			&query.GreaterOrEqual{Field: "age", Value: 10},
+			&query.Or{&query.NotIn{Field: "name", Values: []query.Value{"Bob"}}, &query.LowerOrEqual{Field: "height", Value: 1.5}},
+		}),
+	}
+	for i, predicate := range predicates {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{Predicate: predicate, Sort: query.Sort{{Name: "name"}}}
+		lq := &LuaQuery{ReadOnly: true}
+		assert.NoError(t, lq.addSelect(keyspace{prefix: "users"}, q), msg)
+		assert.NoError(t, lq.addSortWithLimit(q, -1, 0, []string{"name", "age"}, []string{"age"}), msg)
+		assert.True(t, lq.ReadOnly, msg)
+		assert.Empty(t, lq.AllKeys, msg)
+		assert.False(t, writes.MatchString(lq.Script), msg)
+	}
+
+	// test the same queries write temporary keys otherwise
+	q := &query.Query{Predicate: predicates[1]}
+	lq := new(LuaQuery)
+	assert.NoError(t, lq.addSelect(keyspace{prefix: "users"}, q))
+	assert.True(t, writes.MatchString(lq.Script))
+}
+
+func TestLuaQuery_SingleKeySort(t *testing.T) {
+	cases := []struct {
+		predicate query.Predicate
+		sortInLua bool
+		want      bool
+	}{
+		{nil, false, true},
+		{query.Predicate{&query.Equal{Field: "name", Value: "Bob"}}, false, true},
+		{nil, true, false},
+		{query.Predicate{&query.Equal{Field: "age", Value: 7}}, false, false},
+		{query.Predicate{&query.Equal{Field: "name", Value: "Bob"}, &query.Equal{Field: "male", Value: "true"}}, false, false},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{Predicate: tc.predicate, Sort: query.Sort{{Name: "name"}}}
+		lq := &LuaQuery{ReadOnly: true, SortInLua: tc.sortInLua}
+		assert.NoError(t, lq.addSelect(keyspace{prefix: "users"}, q), msg)
+		assert.NoError(t, lq.addSortWithLimit(q, 10, 0, []string{"name"}, nil), msg)
+		assert.True(t, lq.ReadOnly, msg)
+		assert.Equal(t, tc.want, strings.Contains(lq.Script, "redis.call('SORT'"), msg)
+	}
+}
+
+func TestTranslatePredicate_TempKeys(t *testing.T) {
+	predicates := []query.Predicate{
+		{&query.LowerOrEqual{Field: "age", Value: 3}},
+		{&query.NotIn{Field: "name", Values: []query.Value{"a", "b"}}},
+		{&query.In{Field: "age", Values: []query.Value{1, 2}}},
+		{&query.NotEqual{Field: "age", Value: 1}},
+		{&query.Exist{Field: "name"}},
+		{&query.ElemMatch{Field: "comments", Exps: []query.Expression{&query.Equal{Field: "author", Value: "Bob"}}}},
+		normalizePredicate(query.Predicate{
+			&query.GreaterThan{Field: "age", Value: 10},
+			&query.Or{&query.Equal{Field: "name", Value: "Bob"}, &query.LowerOrEqual{Field: "height", Value: 1.5}},
+			&query.And{&query.In{Field: "name", Values: []query.Value{"Bob"}}},
+		}),
+	}
+	for i, predicate := range predicates {
+		msg := fmt.Sprintf("Test case #%d", i)
+		p := new(luaParams)
+		_, script, tempKeys, err := translatePredicate(p, keyspace{prefix: "users"}, predicate)
+		assert.NoError(t, err, msg)
+
+		// every created temporary key is returned once and expires
+		var created []string
+		for i, k := range p.Keys {
+			if strings.HasPrefix(k, "users:tmp_") {
+				created = append(created, fmt.Sprintf("KEYS[%d]", i+1))
+			}
+		}
+		assert.ElementsMatch(t, created, tempKeys, msg)
+
+		// every command storing a temporary key is followed by its expiry right away
+		var lines []string
+		for _, line := range strings.Split(script, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		store := regexp.MustCompile(`^redis\.call\('(?:SADD|SUNIONSTORE|SDIFFSTORE|ZUNIONSTORE|ZINTERSTORE)', (KEYS\[\d+\])`)
+		expired := make(map[string]bool)
+		for i, line := range lines {
+			m := store.FindStringSubmatch(line)
+			if m == nil || !inSlice(m[1], tempKeys) {
+				continue
+			}
+			if assert.True(t, i+1 < len(lines), msg) {
+				assert.Equal(t, fmt.Sprintf("redis.call('PEXPIRE', %s, 60000)", m[1]), lines[i+1], msg)
+			}
+			expired[m[1]] = true
+		}
+		assert.Len(t, expired, len(tempKeys), msg)
+	}
+}
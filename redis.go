@@ -2,8 +2,12 @@ package rds
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/go-redis/redis"
 	"github.com/rs/rest-layer/resource"
@@ -19,16 +23,44 @@ const (
 
 // Handler handles resource storage in Redis.
 type Handler struct {
-	client     *redis.Client
+	client  redis.Cmdable
 	manager *ItemManager
+	scripts *scriptCache
+	// replicas Find is run with, the primary client is used if there are none.
+	replicas *replicaPool
+	// regexScanLimit is a number of values of a field a regex filter may be matched against.
+	regexScanLimit int
+	// lenient makes Find skip corrupted items instead of failing.
+	lenient     bool
+	onCorrupted func(key string, err error)
+	// tenant extracts a tenant of a request, all keys are scoped to it.
+	tenant func(ctx context.Context) (string, error)
+	// checkedKeys are prefixes of the keyspaces known to be stored with the handler's key encoding and layout.
+	checkedKeys *sync.Map
 }
 
-// NewHandler creates a new redis handler
-func NewHandler(c *redis.Client, entityName string, schema schema.Schema) *Handler {
-	var filterable, sortable, numeric []string
+// ErrNoTenant is returned when a handler with a tenant extractor gets a request without a tenant.
+var ErrNoTenant = errors.New("no tenant in context")
+
+// NewHandler creates a new redis handler.
+// Any go-redis client may be used: *redis.Client (including the one created by redis.NewFailoverClient for Sentinel),
+// *redis.ClusterClient, *redis.Ring, etc. With the clients that distribute keys among several servers
+// (*redis.ClusterClient and *redis.Ring) all keys of the entity are hash-tagged (see WithHashTags).
+// The handler is configured with options, an error is returned if their combination is invalid.
+func NewHandler(c redis.Cmdable, entityName string, s schema.Schema, opts ...Option) (*Handler, error) {
+	var fields, filterable, sortable, numeric, arrays []string
+
+	// id and updated are always stored in a payload
+	fields = append(fields, "id", "updated")
+
+	for k := range s.Fields {
+		if !inSlice(k, fields) {
+			fields = append(fields, k)
+		}
+	}
 
 	// TODO - better?
-	for k, v := range schema.Fields {
+	walkFields("", s.Fields, func(k string, v schema.Field) {
 		// ID is always filterable - needed for queries.
 		if k == "id" {
 			filterable = append(filterable, k)
@@ -42,110 +74,117 @@ func NewHandler(c *redis.Client, entityName string, schema schema.Schema) *Handl
 		}
 
 		// Detect possible numeric-value fields
-		// TODO - don't use reflection? Use isNumeric?
-		t := fmt.Sprintf("%T", v.Validator)
-		if t == "Integer" || t == "Float" || t == "Time" {
+		switch t := v.Validator.(type) {
+		case *schema.Integer, *schema.Float, *schema.Time:
 			numeric = append(numeric, k)
+		case *schema.Array:
+			if _, ok := t.Values.Validator.(*schema.Object); !ok {
+				arrays = append(arrays, k)
+			}
 		}
-	}
+	})
 
-	return &Handler{
-		client:     c,
+	sort.Strings(fields)
+
+	h := &Handler{
+		client:  c,
 		manager: &ItemManager{
 			EntityName: entityName,
-			FieldNames: []string{ETagField, payloadField},
+			HashTags:   isSharded(c),
+			Layout:     FieldsLayout,
+			Codec:      GobCodec,
+			Schema:     &s,
+			Fields:     fields,
 			Filterable: filterable,
 			Sortable:   sortable,
 			Numeric:    numeric,
+			Arrays:     arrays,
 		},
+		scripts:        newScriptCache(),
+		regexScanLimit: defaultRegexScanLimit,
+		checkedKeys:    new(sync.Map),
+	}
+
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
 	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	h.manager.FieldNames = h.manager.Layout.hashFields(fields)
+
+	return h, nil
 }
 
-// Insert inserts new items in the Redis database
+// walkFields calls fn for every field of a schema and for every field of its nested objects.
+// Nested fields are denoted by their dotted paths, e.g. 'meta.title', as in rest-layer queries.
+// Fields of objects inside arrays are not walked: they are matched by ElemMatch filters in their own keyspace.
+func walkFields(prefix string, fields schema.Fields, fn func(path string, f schema.Field)) {
+	for k, v := range fields {
+		path := prefix + k
+		fn(path, v)
+
+		sub := v.Schema
+		if obj, ok := v.Validator.(*schema.Object); ok && sub == nil {
+			sub = obj.Schema
+		}
+		if sub != nil {
+			walkFields(path+".", sub.Fields, fn)
+		}
+	}
+}
+
+// Insert inserts new items in the Redis database.
+// Items are checked for duplicates and written along with their secondary indices by a single script,
+// so either all of them are inserted or none.
 func (h *Handler) Insert(ctx context.Context, items []*resource.Item) error {
 	err := handleWithContext(ctx, func() error {
-		// Check for duplicates with a bulk request
-		var ids []string
-		for _, item := range items {
-			ids = append(ids, h.manager.RedisItemKey(item))
+		im, err := h.itemManager(ctx)
+		if err != nil {
+			return err
 		}
 		// TODO - bulk inserts are not supported by REST-layer now
-		// TODO: is atomic? Add WATCH?
-		duplicates, err := h.client.Exists(ids...).Result()
-		// TODO: is it real not found???
+		p, err := im.insertParams(items)
 		if err != nil {
 			return err
 		}
-		if duplicates > 0 {
-			return resource.ErrConflict
-		}
-
-		pipe := h.client.TxPipeline()
-
-		// Add record and secondary indices
-		for _, item := range items {
-			key, value := h.manager.NewRedisItem(item)
-			pipe.HMSet(key, value)
-			// Add secondary indices for filterable fields
-			h.manager.AddSecondaryIndices(pipe, item)
-			h.manager.AddIDToAllIDsSet(pipe, item)
-		}
-
-		_, err = pipe.Exec()
-		return err
+		return scriptError(insertScript.Run(h.client, p.Keys, p.Args...).Err())
 	})
 
 	return err
 }
 
-// Update updates item properties in Redis
+// Update updates item properties in Redis.
+// The stored item's ETag is checked and the item is replaced along with its secondary indices by a single script,
+// so a concurrent writer can't slip in between.
 func (h Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
 	err := handleWithContext(ctx, func() error {
-		key, value := h.manager.NewRedisItem(item)
-
-		// TODO: original?
-		// TODO - is it atomic?
-		if err := h.checkPresenceAndETag(key, original); err != nil {
+		im, err := h.itemManager(ctx)
+		if err != nil {
 			return err
 		}
-
-		pipe := h.client.TxPipeline()
-		// TODO: HSet?
-		pipe.HMSet(key, value)
-
-		h.manager.DeleteSecondaryIndices(pipe, original)
-		h.manager.AddSecondaryIndices(pipe, item)
-
-		// TODO - we need it?
-		h.manager.DeleteIDFromAllIDsSet(pipe, item)
-		h.manager.AddIDToAllIDsSet(pipe, original)
-
-		_, err := pipe.Exec()
-		return err
+		p, err := im.updateParams(item, original)
+		if err != nil {
+			return err
+		}
+		return scriptError(updateScript.Run(h.client, p.Keys, p.Args...).Err())
 	})
 
 	return err
 }
 
-// Delete deletes an item from Redis
+// Delete deletes an item from Redis.
+// The stored item's ETag is checked and the item is deleted along with its secondary indices by a single script.
 func (h Handler) Delete(ctx context.Context, item *resource.Item) error {
 	err := handleWithContext(ctx, func() error {
-		key, _ := h.manager.NewRedisItem(item)
-
-		// TODO - is it atomic?
-		if err := h.checkPresenceAndETag(key, item); err != nil {
+		im, err := h.itemManager(ctx)
+		if err != nil {
 			return err
 		}
-
-		pipe := h.client.TxPipeline()
-		pipe.Del(h.manager.RedisItemKey(item))
-
-		// todo - is it atomic?
-		h.manager.DeleteSecondaryIndices(pipe, item)
-		h.manager.DeleteIDFromAllIDsSet(pipe, item)
-
-		_, err := pipe.Exec()
-		return err
+		p := im.deleteParams(item)
+		return scriptError(deleteScript.Run(h.client, p.Keys, p.Args...).Err())
 	})
 
 	return err
@@ -155,18 +194,23 @@ func (h Handler) Delete(ctx context.Context, item *resource.Item) error {
 func (h Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 	result := -1
 	err := handleWithContext(ctx, func() error {
+		im, err := h.itemManager(ctx)
+		if err != nil {
+			return err
+		}
 		luaQuery := new(LuaQuery)
 
-		if err := luaQuery.addSelect(h.manager.EntityName, q); err != nil {
+		// Items are deleted from the primary, so the values of regex filters are read from there as well
+		if err := h.addSelect(ReadFromPrimary(ctx), im, luaQuery, q); err != nil {
 			return err
 		}
 
-		luaQuery.addDelete(h.manager.EntityName)
+		luaQuery.addDelete(im.keys())
 
-		var err error
 		var res interface{}
-		qs := redis.NewScript(luaQuery.Script)
-		res, err = qs.Run(h.client, []string{}).Result()
+		qs := h.scripts.get(luaQuery.Script)
+		scriptKeys, scriptArgs := luaQuery.bound()
+		res, err = qs.Run(h.client, scriptKeys, scriptArgs...).Result()
 		if err != nil {
 			return err
 		}
@@ -187,8 +231,16 @@ func (h Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 	var result *resource.ItemList
 
 	err := handleWithContext(ctx, func() error {
-		luaQuery := new(LuaQuery)
-		if err := luaQuery.addSelect(h.manager.EntityName, q); err != nil {
+		im, err := h.itemManager(ctx)
+		if err != nil {
+			return err
+		}
+		// Items stored with BlobLayout have no hash fields to sort them by
+		if len(q.Sort) > 0 && im.Layout == BlobLayout {
+			return resource.ErrNotImplemented
+		}
+		luaQuery := &LuaQuery{SortInLua: im.HashTags, ReadOnly: true}
+		if err := h.addSelect(ctx, im, luaQuery, q); err != nil {
 			return err
 		}
 
@@ -202,30 +254,49 @@ func (h Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 			}
 		}
 
-		if err := luaQuery.addSortWithLimit(q, limit, offset, h.manager.FieldNames, h.manager.Numeric); err != nil {
+		if err := luaQuery.addSortWithLimit(q, limit, offset, im.FieldNames, im.Numeric); err != nil {
 			return err
 		}
 
-		qs := redis.NewScript(luaQuery.Script)
-		data, err := qs.Run(h.client, []string{}, "value").Result()
+		// Queries that store temporary keys can't be run on replicas
+		var data interface{}
+		qs := h.scripts.get(luaQuery.Script)
+		scriptKeys, scriptArgs := luaQuery.bound()
+		run := func(c redis.Cmdable) error {
+			data, err = qs.Run(c, scriptKeys, scriptArgs...).Result()
+			return err
+		}
+		if luaQuery.ReadOnly {
+			err = h.read(ctx, run)
+		} else {
+			err = run(h.client)
+		}
 		if err != nil {
 			return err
 		}
 
-		// TODO: implement properly
-		items := []*resource.Item{}
-		d := data.([]interface{})
-
-		// chunk data by items
-		chunk := len(h.manager.FieldNames)
-		for i := 0; i < len(d); i += chunk {
-			v := d[i : i+chunk]
-			items = append(items, h.manager.NewItem(v))
+		// The script returns the total count of found items and the items themselves.
+		res := data.([]interface{})
+		total := int(res[0].(int64))
+		d := res[1].([]interface{})
+
+		// chunk data by items: the item's key goes first, then its fields
+		var keys []string
+		var values [][]interface{}
+		chunk := len(im.FieldNames) + 1
+		for i := 0; i+chunk <= len(d); i += chunk {
+			key, _ := d[i].(string)
+			keys = append(keys, key)
+			values = append(values, d[i+1:i+chunk])
+		}
+		items, err := h.newItems(im, keys, values)
+		if err != nil {
+			return err
 		}
 
-		// TODO - is len(items) correct?
+		// Skipped corrupted items are not counted
 		result = &resource.ItemList{
-			Total: len(items),
+			Total: total - (len(keys) - len(items)),
 			Limit: limit,
 			Items: items,
 		}
@@ -235,20 +306,160 @@ func (h Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 	return result, err
 }
 
-// checkPresenceAndETag checks if record is stored in DB (by its ID) and its ETag is the same as ETag in provided item.
-// If no result found - no item is stored in the DB.
-// If found - we should compare ETags.
-func (h *Handler) checkPresenceAndETag(key string, item *resource.Item) error {
-	current, err := h.client.HGet(key, ETagField).Result()
-	// TODO: is it a real not found???
-	if err != nil || current == "" {
-		return resource.ErrNotFound
+// Count returns the number of items matching the query's predicate. Items themselves are not fetched.
+func (h Handler) Count(ctx context.Context, q *query.Query) (int, error) {
+	var result int
+
+	err := handleWithContext(ctx, func() error {
+		im, err := h.itemManager(ctx)
+		if err != nil {
+			return err
+		}
+
+		// All items are counted without a script
+		if len(q.Predicate) == 0 {
+			return h.read(ctx, func(c redis.Cmdable) error {
+				n, err := c.SCard(im.keys().allIDs()).Result()
+				result = int(n)
+				return err
+			})
+		}
+
+		luaQuery := &LuaQuery{ReadOnly: true}
+		if err := h.addSelect(ctx, im, luaQuery, q); err != nil {
+			return err
+		}
+		luaQuery.addReturnCount()
+
+		var n int64
+		qs := h.scripts.get(luaQuery.Script)
+		scriptKeys, scriptArgs := luaQuery.bound()
+		run := func(c redis.Cmdable) error {
+			n, err = qs.Run(c, scriptKeys, scriptArgs...).Int64()
+			return err
+		}
+		if luaQuery.ReadOnly {
+			err = h.read(ctx, run)
+		} else {
+			err = run(h.client)
+		}
+		result = int(n)
+		return err
+	})
+	return result, err
+}
+
+// MultiGet retrieves items by their IDs with a single pipelined round trip to Redis.
+// Items are returned in the order of the requested IDs. Missing items are omitted as resource.MultiGetter requires,
+// rest-layer's Resource.MultiGet puts nil in their places.
+func (h Handler) MultiGet(ctx context.Context, ids []interface{}) ([]*resource.Item, error) {
+	var result []*resource.Item
+
+	err := handleWithContext(ctx, func() error {
+		im, err := h.itemManager(ctx)
+		if err != nil {
+			return err
+		}
+		ks := im.keys()
+
+		var cmds []*redis.SliceCmd
+		err = h.read(ctx, func(c redis.Cmdable) error {
+			pipe := c.Pipeline()
+			cmds = make([]*redis.SliceCmd, 0, len(ids))
+			for _, id := range ids {
+				cmds = append(cmds, pipe.HMGet(ks.item(id), im.FieldNames...))
+			}
+			_, err := pipe.Exec()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		var values [][]interface{}
+		for i, cmd := range cmds {
+			// HMGET returns no values of a missing hash
+			if !hasValues(cmd.Val()) {
+				continue
+			}
+			keys = append(keys, ks.item(ids[i]))
+			values = append(values, cmd.Val())
+		}
+		result, err = h.newItems(im, keys, values)
+		return err
+	})
+	return result, err
+}
+
+// newItems creates items from the values of their hash fields read from Redis.
+// In lenient mode corrupted items are skipped and quarantined, otherwise the first one fails the request.
+func (h Handler) newItems(im *ItemManager, keys []string, values [][]interface{}) ([]*resource.Item, error) {
+	items := []*resource.Item{}
+	var corrupted []interface{}
+	for i, key := range keys {
+		item, err := im.NewItem(key, values[i])
+		if err != nil {
+			if !h.lenient {
+				return nil, err
+			}
+			corrupted = append(corrupted, key)
+			if h.onCorrupted != nil {
+				h.onCorrupted(key, err)
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(corrupted) > 0 {
+		if err := h.client.SAdd(im.keys().quarantine(), corrupted...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// addSelect adds the selection of items matching a query's predicate to a query script.
+func (h Handler) addSelect(ctx context.Context, im *ItemManager, lq *LuaQuery, q *query.Query) error {
+	predicate, err := h.resolveRegexes(ctx, im.keys(), q.Predicate)
+	if err != nil {
+		return err
+	}
+	return lq.addSelect(im.keys(), &query.Query{Predicate: predicate})
+}
+
+// itemManager returns the ItemManager for a request, once the items are checked to be stored as it expects.
+func (h *Handler) itemManager(ctx context.Context) (*ItemManager, error) {
+	im, err := h.scopedItemManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkKeys(im); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// scopedItemManager returns the ItemManager for a request.
+// With a tenant extractor it's a copy of the handler's one scoped to the request's tenant.
+func (h *Handler) scopedItemManager(ctx context.Context) (*ItemManager, error) {
+	if h.tenant == nil {
+		return h.manager, nil
+	}
+	tenant, err := h.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == "" {
+		return nil, ErrNoTenant
 	}
-	// TODO: make type-assertion?
-	if string(current) != item.ETag {
-		return resource.ErrConflict
+	// Tenants are escaped in keys unless PlainKeys are used
+	if h.manager.HashTags && h.manager.KeyEncoding == PlainKeys && strings.ContainsAny(tenant, "{}") {
+		return nil, fmt.Errorf("tenant %q can't contain braces with hash tags", tenant)
 	}
-	return nil
+	im := *h.manager
+	im.Tenant = tenant
+	return &im, nil
 }
 
 // handleWithContext makes requests to Redis aware of context.
@@ -0,0 +1,195 @@
+package rds_test
+
+import (
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+var postSchema = schema.Schema{
+	Fields: schema.Fields{
+		"id": schema.IDField,
+		"tags": {
+			Filterable: true,
+			Validator: &schema.Array{
+				Values: schema.Field{Validator: &schema.String{}},
+			},
+		},
+		"scores": {
+			Filterable: true,
+			Validator: &schema.Array{
+				Values: schema.Field{Validator: &schema.Integer{}},
+			},
+		},
+		"comments": {
+			Filterable: true,
+			Validator: &schema.Array{
+				Values: schema.Field{
+					Validator: &schema.Object{
+						Schema: &schema.Schema{
+							Fields: schema.Fields{
+								"author": {Validator: &schema.String{}},
+								"likes":  {Validator: &schema.Integer{}},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func getPosts() []*resource.Item {
+	return []*resource.Item{
+		{ID: "post1", ETag: "a", Payload: map[string]interface{}{
+			"id":     "post1",
+			"tags":   []interface{}{"go", "redis"},
+			"scores": []interface{}{1, 5},
+			"comments": []interface{}{
+				map[string]interface{}{"author": "Bob", "likes": 1},
+				map[string]interface{}{"author": "Ann", "likes": 5},
+			},
+		}},
+		{ID: "post2", ETag: "b", Payload: map[string]interface{}{
+			"id":     "post2",
+			"tags":   []interface{}{"go"},
+			"scores": []interface{}{5},
+			"comments": []interface{}{
+				map[string]interface{}{"author": "Bob", "likes": 7},
+			},
+		}},
+		{ID: "post3", ETag: "c", Payload: map[string]interface{}{
+			"id":   "post3",
+			"tags": []interface{}{"lua"},
+		}},
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_Arrays() {
+	handler, err := rds.NewHandler(s.client, "posts", postSchema)
+	s.Require().NoError(err)
+	posts := getPosts()
+	s.NoError(handler.Insert(s.ctx, posts))
+
+	bobLiked := func(likes int) query.Expression {
+		return &query.ElemMatch{Field: "comments", Exps: []query.Expression{
+			&query.Equal{Field: "author", Value: "Bob"},
+			&query.GreaterThan{Field: "likes", Value: likes},
+		}}
+	}
+	q := &query.Query{Window: &query.Window{Limit: -1}}
+
+	// test can find by an element of an array
+	q.Predicate = query.Predicate{&query.Equal{Field: "tags", Value: "go"}}
+	s.ElementsMatch([]string{"post1", "post2"}, s.findIDs(handler, q))
+	n, err := handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(2, n)
+	q.Predicate = query.Predicate{&query.In{Field: "tags", Values: []query.Value{"redis", "lua"}}}
+	s.ElementsMatch([]string{"post1", "post3"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.NotIn{Field: "tags", Values: []query.Value{"go"}}}
+	s.Equal([]string{"post3"}, s.findIDs(handler, q))
+
+	// test can find by a numeric element of an array
+	q.Predicate = query.Predicate{&query.Equal{Field: "scores", Value: 5}}
+	s.ElementsMatch([]string{"post1", "post2"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.In{Field: "scores", Values: []query.Value{1, 7}}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.NotIn{Field: "scores", Values: []query.Value{1}}}
+	s.ElementsMatch([]string{"post2", "post3"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.NotEqual{Field: "scores", Value: 5}}
+	s.Equal([]string{"post3"}, s.findIDs(handler, q))
+
+	// test all the expressions of ElemMatch apply to the same element:
+	// Ann has 5 likes on post1, but it's not Bob's comment
+	q.Predicate = query.Predicate{bobLiked(3)}
+	s.Equal([]string{"post2"}, s.findIDs(handler, q))
+	n, err = handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(1, n)
+	q.Predicate = query.Predicate{bobLiked(0)}
+	s.ElementsMatch([]string{"post1", "post2"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.In{Field: "author", Values: []query.Value{"Ann", "Eve"}},
+	}}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{bobLiked(0), &query.Equal{Field: "tags", Value: "redis"}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+
+	// test the indices of elements are updated along with items
+	updated := &resource.Item{ID: "post2", ETag: "new", Payload: map[string]interface{}{
+		"id":   "post2",
+		"tags": []interface{}{"lua"},
+		"comments": []interface{}{
+			map[string]interface{}{"author": "Ann", "likes": 7},
+		},
+	}}
+	s.NoError(handler.Update(s.ctx, updated, posts[1]))
+	q.Predicate = query.Predicate{&query.Equal{Field: "tags", Value: "go"}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.NotIn{Field: "tags", Values: []query.Value{"go"}}}
+	s.ElementsMatch([]string{"post2", "post3"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.Equal{Field: "scores", Value: 5}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{bobLiked(0)}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{bobLiked(3)}
+	s.Empty(s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Equal{Field: "author", Value: "Ann"},
+	}}}
+	s.ElementsMatch([]string{"post1", "post2"}, s.findIDs(handler, q))
+
+	// elements of arrays can't be compared by ranges
+	for _, exp := range []query.Expression{
+		&query.GreaterThan{Field: "scores", Value: 1},
+		&query.LowerOrEqual{Field: "scores", Value: 1},
+	} {
+		q := &query.Query{Predicate: query.Predicate{exp}}
+		_, err = handler.Find(s.ctx, q)
+		s.Equal(resource.ErrNotImplemented, err)
+		_, err = handler.Clear(s.ctx, q)
+		s.Equal(resource.ErrNotImplemented, err)
+	}
+
+	// test the indices of elements are deleted along with items
+	s.NoError(handler.Delete(s.ctx, posts[0]))
+	q.Predicate = query.Predicate{&query.In{Field: "tags", Values: []query.Value{"redis", "lua"}}}
+	s.ElementsMatch([]string{"post2", "post3"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.Equal{Field: "scores", Value: 5}}
+	s.Empty(s.findIDs(handler, q))
+	q.Predicate = query.Predicate{bobLiked(0)}
+	s.Empty(s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.In{Field: "author", Values: []query.Value{"Ann", "Eve"}},
+	}}}
+	s.Equal([]string{"post2"}, s.findIDs(handler, q))
+
+	// Clear translates the predicate with the temporary keys
+	n, err = handler.Clear(s.ctx, &query.Query{Predicate: query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Equal{Field: "author", Value: "Ann"},
+	}}}})
+	s.NoError(err)
+	s.Equal(1, n)
+	n, err = handler.Clear(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Equal(1, n)
+	s.Equal([]string{"posts:keys_version"}, s.client.Keys("*").Val())
+}
+
+func (s *RedisMainTestSuite) TestFind_ElemMatchPlainKeys() {
+	handler, err := rds.NewHandler(s.client, "posts", postSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	s.NoError(handler.Insert(s.ctx, getPosts()))
+
+	_, err = handler.Find(s.ctx, &query.Query{Predicate: query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Equal{Field: "author", Value: "Bob"},
+	}}}})
+	s.Equal(resource.ErrNotImplemented, err)
+
+	res, err := handler.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}, Predicate: query.Predicate{&query.Equal{Field: "tags", Value: "go"}}})
+	s.NoError(err)
+	s.Len(res.Items, 2)
+}
@@ -0,0 +1,195 @@
+package rds_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/stretchr/testify/suite"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+// Servers the tests of different client kinds are run against. Tests of a client kind are skipped if not set.
+const (
+	// A comma-separated list of Redis Cluster nodes.
+	// Ex: REDIS_CLUSTER_ADDRS=127.0.0.1:7000,127.0.0.1:7001,127.0.0.1:7002
+	clusterAddressesEnv = "REDIS_CLUSTER_ADDRS"
+	// A comma-separated list of Sentinel nodes and a name of the master monitored by them.
+	// Ex: REDIS_SENTINEL_ADDRS=127.0.0.1:26379 REDIS_SENTINEL_MASTER=mymaster
+	sentinelAddressesEnv = "REDIS_SENTINEL_ADDRS"
+	sentinelMasterEnv    = "REDIS_SENTINEL_MASTER"
+	// A comma-separated list of redis.Ring shards. The main Redis server is used as a single shard if not set.
+	// Ex: REDIS_RING_ADDRS=127.0.0.1:6379,127.0.0.1:6380
+	ringAddressesEnv = "REDIS_RING_ADDRS"
+)
+
+// RedisClientsTestSuite checks the handler with a go-redis client of some kind.
+type RedisClientsTestSuite struct {
+	suite.Suite
+
+	// newClient creates a client of the tested kind.
+	newClient func() redis.Cmdable
+	// flush purges all servers the client is connected to.
+	flush func(c redis.Cmdable) error
+	// keyspace all keys of the users entity should start with.
+	keyspace string
+
+	client  redis.Cmdable
+	handler *rds.Handler
+	ctx     context.Context
+}
+
+func TestClusterClientSuite(t *testing.T) {
+	addrs := os.Getenv(clusterAddressesEnv)
+	if addrs == "" {
+		t.Skipf("%s is not set", clusterAddressesEnv)
+	}
+	suite.Run(t, &RedisClientsTestSuite{
+		newClient: func() redis.Cmdable {
+			return redis.NewClusterClient(&redis.ClusterOptions{Addrs: strings.Split(addrs, ",")})
+		},
+		flush: func(c redis.Cmdable) error {
+			return c.(*redis.ClusterClient).ForEachMaster(func(c *redis.Client) error {
+				return c.FlushDB().Err()
+			})
+		},
+		keyspace: "{users}",
+	})
+}
+
+func TestFailoverClientSuite(t *testing.T) {
+	addrs := os.Getenv(sentinelAddressesEnv)
+	if addrs == "" {
+		t.Skipf("%s is not set", sentinelAddressesEnv)
+	}
+	master := os.Getenv(sentinelMasterEnv)
+	if master == "" {
+		master = "mymaster"
+	}
+	suite.Run(t, &RedisClientsTestSuite{
+		newClient: func() redis.Cmdable {
+			return redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:    master,
+				SentinelAddrs: strings.Split(addrs, ","),
+			})
+		},
+		flush: func(c redis.Cmdable) error {
+			return c.FlushDB().Err()
+		},
+		keyspace: "users",
+	})
+}
+
+func TestRingClientSuite(t *testing.T) {
+	addrs := []string{redisAddress}
+	if env := os.Getenv(ringAddressesEnv); env != "" {
+		addrs = strings.Split(env, ",")
+	}
+	shards := make(map[string]string)
+	for _, addr := range addrs {
+		shards[addr] = addr
+	}
+	suite.Run(t, &RedisClientsTestSuite{
+		newClient: func() redis.Cmdable {
+			return redis.NewRing(&redis.RingOptions{Addrs: shards})
+		},
+		flush: func(c redis.Cmdable) error {
+			return c.(*redis.Ring).ForEachShard(func(c *redis.Client) error {
+				return c.FlushDB().Err()
+			})
+		},
+		keyspace: "{users}",
+	})
+}
+
+func (s *RedisClientsTestSuite) SetupSuite() {
+	s.client = s.newClient()
+
+	_, err := s.client.Ping().Result()
+	if err != nil {
+		s.T().Fatal(err)
+	}
+
+	s.handler, err = rds.NewHandler(s.client, usersEntity, userSchema)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	s.ctx = context.Background()
+}
+
+func (s *RedisClientsTestSuite) SetupTest() {
+	s.NoError(s.flush(s.client))
+}
+
+func (s *RedisClientsTestSuite) TearDownTest() {
+	s.NoError(s.flush(s.client))
+}
+
+func (s *RedisClientsTestSuite) TestCRUD() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	// test keys are stored where expected
+	s.Equal(int64(1), s.client.Exists(s.keyspace+":item:find_id1").Val())
+	s.Equal(int64(3), s.client.SCard(s.keyspace+":ids").Val())
+
+	// test multi get
+	items, err := s.handler.MultiGet(s.ctx, []interface{}{"find_id2", "missing", "find_id1"})
+	s.NoError(err)
+	s.Len(items, 2)
+	s.Equal("find_id2", items[0].ID)
+	s.Equal("find_id1", items[1].ID)
+
+	// test filtering and sorting
+	q := &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "age", Value: 19}},
+		Sort:      query.Sort{{Name: "name", Reversed: true}},
+	}
+	res, err := s.handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Equal(2, res.Total)
+	s.Len(res.Items, 2)
+	s.Equal("find_id3", res.Items[0].ID)
+	s.Equal("find_id1", res.Items[1].ID)
+
+	q = &query.Query{
+		Window: &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Or{
+			&query.Equal{Field: "name", Value: "Linda"},
+			&query.GreaterThan{Field: "height", Value: 155.1},
+		}},
+		Sort: query.Sort{{Name: "age"}},
+	}
+	res, err = s.handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Len(res.Items, 2)
+	s.Equal("find_id2", res.Items[0].ID)
+	s.Equal("find_id1", res.Items[1].ID)
+
+	// test update and delete
+	linda := getPersons()[1]
+	updated := &resource.Item{ID: linda.ID, ETag: "new", Payload: map[string]interface{}{"name": "Lin", "age": 8}}
+	s.NoError(s.handler.Update(s.ctx, updated, linda))
+	s.EqualError(s.handler.Delete(s.ctx, linda), "Conflict")
+	s.NoError(s.handler.Delete(s.ctx, updated))
+
+	// test clear
+	n, err := s.handler.Clear(s.ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "male", Value: true}}})
+	s.NoError(err)
+	s.Equal(2, n)
+	s.Equal(int64(0), s.client.SCard(s.keyspace+":ids").Val())
+}
+
+func (s *RedisClientsTestSuite) TestDeleteTemporaryKeys() {
+	s.NoError(s.client.SAdd(s.keyspace+":tmp_1_2", s.keyspace+":item:find_id1").Err())
+	n, err := s.handler.DeleteTemporaryKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(1, n)
+	s.Equal(int64(0), s.client.Exists(s.keyspace+":tmp_1_2").Val())
+}
@@ -0,0 +1,44 @@
+package rds_test
+
+import (
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+// check the handler is used by rest-layer for counts
+var _ resource.Counter = rds.Handler{}
+
+func (s *RedisMainTestSuite) TestCount() {
+	n, err := s.handler.Count(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Equal(0, n)
+
+	err = s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	cases := []struct {
+		predicate query.Predicate
+		want      int
+	}{
+		{nil, 3},
+		{query.Predicate{&query.Equal{Field: "age", Value: 19}}, 2},
+		{query.Predicate{&query.Equal{Field: "name", Value: "Nobody"}}, 0},
+		{query.Predicate{&query.NotIn{Field: "name", Values: []query.Value{"Bob"}}}, 2},
+		{query.Predicate{
+			&query.GreaterThan{Field: "height", Value: 100},
+			&query.Or{&query.Equal{Field: "name", Value: "Bob"}, &query.LowerThan{Field: "age", Value: 10}},
+		}, 1},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		// window doesn't limit the count
+		n, err := s.handler.Count(s.ctx, &query.Query{Predicate: tc.predicate, Window: &query.Window{Limit: 1}})
+		s.NoError(err, msg)
+		s.Equal(tc.want, n, msg)
+	}
+	s.Empty(s.client.Keys("users:tmp_*").Val())
+}
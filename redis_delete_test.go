@@ -60,10 +60,10 @@ func (s *RedisMainTestSuite) TestDelete() {
 	s.Len(res.Items, 1)
 	s.Equal("Linda", res.Items[0].Payload["name"])
 
-	// test no entries left and DB is totally empty
+	// test no entries left and DB is totally empty (but the keys version marker)
 	err = s.handler.Delete(s.ctx, linda)
 	s.NoError(err)
-	s.Zero(s.client.DbSize().Val())
+	s.Equal([]string{"users:keys_version"}, s.client.Keys("*").Val())
 }
 
 
@@ -101,3 +101,17 @@ func (s *RedisMainTestSuite) TestDelete_Conflict() {
 	s.Equal("asdf", res.Items[0].ETag)
 	s.Equal("Bob", res.Items[0].Payload["name"])
 }
+
+func (s *RedisMainTestSuite) TestDelete_NotFound() {
+	bob := &resource.Item{
+		ID:   "del_id4",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  35,
+			"name": "Bob",
+		},
+	}
+
+	err := s.handler.Delete(s.ctx, bob)
+	s.EqualError(err, "Not Found")
+}
@@ -0,0 +1,70 @@
+package rds_test
+
+import (
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+func (s *RedisMainTestSuite) TestFind_Exist() {
+	persons := getPersons()
+	err := s.handler.Insert(s.ctx, persons)
+	s.NoError(err)
+
+	// test can find items having a value of a field
+	q := &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Exist{Field: "male"}},
+		Sort:      query.Sort{{Name: "age"}, {Name: "name"}},
+	}
+	s.Equal([]string{"find_id1", "find_id3"}, s.findIDs(s.handler, q))
+	n, err := s.handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(2, n)
+	q.Predicate = query.Predicate{&query.Exist{Field: "age"}}
+	s.Equal([]string{"find_id2", "find_id1", "find_id3"}, s.findIDs(s.handler, q))
+
+	// test can find items not having a value of a field
+	q.Predicate = query.Predicate{&query.NotExist{Field: "male"}}
+	s.Equal([]string{"find_id2"}, s.findIDs(s.handler, q))
+	q.Predicate = query.Predicate{&query.NotExist{Field: "age"}}
+	s.Empty(s.findIDs(s.handler, q))
+	n, err = s.handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(0, n)
+
+	// test can combine with other filters
+	q.Predicate = query.Predicate{&query.NotExist{Field: "male"}, &query.LowerThan{Field: "age", Value: 10}}
+	s.Equal([]string{"find_id2"}, s.findIDs(s.handler, q))
+
+	// test the sets are updated along with items
+	linda := persons[1]
+	updated := &resource.Item{ID: linda.ID, ETag: "new", Payload: map[string]interface{}{"name": "Linda", "age": 7, "male": false}}
+	s.NoError(s.handler.Update(s.ctx, updated, linda))
+	q.Predicate = query.Predicate{&query.Exist{Field: "male"}}
+	s.Equal([]string{"find_id2", "find_id1", "find_id3"}, s.findIDs(s.handler, q))
+	q.Predicate = query.Predicate{&query.NotExist{Field: "male"}}
+	s.Empty(s.findIDs(s.handler, q))
+
+	// test the sets are updated along with deleted items
+	s.NoError(s.handler.Delete(s.ctx, updated))
+	q.Predicate = query.Predicate{&query.Exist{Field: "age"}}
+	s.Equal([]string{"find_id1", "find_id3"}, s.findIDs(s.handler, q))
+	n, err = s.handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(2, n)
+
+	_, err = s.handler.Clear(s.ctx, &query.Query{Predicate: query.Predicate{&query.Exist{Field: "male"}}})
+	s.NoError(err)
+	s.Equal([]string{"users:keys_version"}, s.client.Keys("*").Val())
+}
+
+func (s *RedisMainTestSuite) TestFind_ExistPlainKeys() {
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	s.NoError(handler.Insert(s.ctx, getPersons()))
+
+	_, err = handler.Find(s.ctx, &query.Query{Predicate: query.Predicate{&query.Exist{Field: "male"}}})
+	s.Equal(resource.ErrNotImplemented, err)
+}
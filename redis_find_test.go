@@ -1,11 +1,14 @@
 package rds_test
 
 import (
-	"time"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/rs/rest-layer/schema/query"
 	"github.com/rs/rest-layer/resource"
+
+	rds "github.com/kolotaev/rest-layer-redis"
 )
 
 func getPersons() []*resource.Item {
@@ -44,6 +47,23 @@ func getPersons() []*resource.Item {
 	return []*resource.Item{bob, linda, jim}
 }
 
+// findIDs finds items with a handler and returns their IDs in the order they are found.
+// The total of the found items is checked too if the query gets all of them.
+func (s *RedisMainTestSuite) findIDs(h *rds.Handler, q *query.Query, msgAndArgs ...interface{}) []string {
+	res, err := h.Find(s.ctx, q)
+	if !s.NoError(err, msgAndArgs...) {
+		return nil
+	}
+	var ids []string
+	for _, item := range res.Items {
+		ids = append(ids, item.ID.(string))
+	}
+	if q.Window == nil || q.Window.Limit < 0 && q.Window.Offset == 0 {
+		s.Equal(len(ids), res.Total, msgAndArgs...)
+	}
+	return ids
+}
+
 func (s *RedisMainTestSuite) TestFind_LimitAndOffset() {
 	err := s.handler.Insert(s.ctx, getPersons())
 	s.NoError(err)
@@ -85,7 +105,7 @@ func (s *RedisMainTestSuite) TestFind_LimitAndOffset() {
 		}
 		res, err := s.handler.Find(s.ctx, q)
 		s.NoError(err, msg)
-		s.Equal(tc.expect, res.Total, msg)
+		s.Equal(2, res.Total, msg)
 		s.Len(res.Items, tc.expect, msg)
 	}
 }
@@ -188,3 +208,251 @@ func (s *RedisMainTestSuite) TestFind_NotEqual() {
 	s.Equal("find_id2", res.Items[1].ID)
 	s.Equal("Linda", res.Items[1].Payload["name"])
 }
+
+func (s *RedisMainTestSuite) TestFind_In() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	cases := []struct {
+		predicate query.Predicate
+		want      []string
+	}{
+		{query.Predicate{&query.In{Field: "age", Values: []query.Value{7, 19}}}, []string{"find_id1", "find_id3", "find_id2"}},
+		{query.Predicate{&query.In{Field: "name", Values: []query.Value{"Bob", "Linda"}}}, []string{"find_id1", "find_id2"}},
+		{query.Predicate{&query.In{Field: "name", Values: []query.Value{"Bob", "Nobody"}}}, []string{"find_id1"}},
+		{query.Predicate{&query.In{Field: "name", Values: []query.Value{"Nobody"}}}, nil},
+		{query.Predicate{&query.NotIn{Field: "age", Values: []query.Value{7}}}, []string{"find_id1", "find_id3"}},
+		{query.Predicate{&query.NotIn{Field: "name", Values: []query.Value{"Bob", "Linda"}}}, []string{"find_id3"}},
+		{query.Predicate{&query.NotIn{Field: "name", Values: []query.Value{"Nobody"}}}, []string{"find_id1", "find_id3", "find_id2"}},
+		// repeated values
+		{query.Predicate{&query.In{Field: "age", Values: []query.Value{19, 19}}}, []string{"find_id1", "find_id3"}},
+		{query.Predicate{&query.In{Field: "name", Values: []query.Value{"Bob", "Bob"}}}, []string{"find_id1"}},
+		{query.Predicate{&query.In{Field: "age", Values: []query.Value{19, 19}}, &query.LowerThan{Field: "age", Value: 30}},
+			[]string{"find_id1", "find_id3"}},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{
+			Window:    &query.Window{Limit: -1},
+			Predicate: tc.predicate,
+			Sort:      query.Sort{{Name: "name"}},
+		}
+		ids := s.findIDs(s.handler, q, msg)
+		s.Equal(tc.want, ids, msg)
+
+		n, err := s.handler.Count(s.ctx, q)
+		s.NoError(err, msg)
+		s.Equal(len(tc.want), n, msg)
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_UnsafeValues() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	cases := []query.Value{
+		"O'Brien",
+		`Bob', 'foo`,
+		"') redis.call('FLUSHALL') --",
+		"]] redis.call('FLUSHALL') --[[",
+		`"\'`,
+	}
+	for i, v := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{
+			Window:    &query.Window{Limit: -1},
+			Predicate: query.Predicate{&query.Equal{Field: "name", Value: v}},
+		}
+		res, err := s.handler.Find(s.ctx, q)
+		s.NoError(err, msg)
+		s.Len(res.Items, 0, msg)
+
+		q = &query.Query{
+			Window:    &query.Window{Limit: -1},
+			Predicate: query.Predicate{&query.NotEqual{Field: "name", Value: v}},
+		}
+		res, err = s.handler.Find(s.ctx, q)
+		s.NoError(err, msg)
+		s.Len(res.Items, 3, msg)
+	}
+
+	// test a value with a quote can be found
+	obrien := &resource.Item{
+		ID:   "find_id4",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  40,
+			"name": "O'Brien",
+		},
+	}
+	err = s.handler.Insert(s.ctx, []*resource.Item{obrien})
+	s.NoError(err)
+	q := &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "name", Value: "O'Brien"}},
+	}
+	res, err := s.handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Len(res.Items, 1)
+	s.Equal("find_id4", res.Items[0].ID)
+	s.Equal("O'Brien", res.Items[0].Payload["name"])
+}
+
+func (s *RedisMainTestSuite) TestFind_SortByMultipleFields() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	cases := []struct {
+		sort   query.Sort
+		window *query.Window
+		expect []string
+	}{
+		{
+			query.Sort{{Name: "age", Reversed: true}, {Name: "name"}},
+			&query.Window{Limit: -1},
+			[]string{"Bob", "Jimmy", "Linda"},
+		},
+		{
+			query.Sort{{Name: "age"}, {Name: "name", Reversed: true}},
+			&query.Window{Limit: -1},
+			[]string{"Linda", "Jimmy", "Bob"},
+		},
+		{
+			query.Sort{{Name: "age"}, {Name: "name", Reversed: true}},
+			&query.Window{Limit: 1, Offset: 1},
+			[]string{"Jimmy"},
+		},
+		{
+			query.Sort{{Name: "age", Reversed: true}, {Name: "name"}},
+			&query.Window{Limit: 5, Offset: 2},
+			[]string{"Linda"},
+		},
+		{
+			query.Sort{{Name: "age", Reversed: true}, {Name: "name"}},
+			&query.Window{Limit: 0},
+			[]string{},
+		},
+		{
+			query.Sort{{Name: "age", Reversed: true}, {Name: "name"}},
+			&query.Window{Limit: 2, Offset: 10},
+			[]string{},
+		},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{
+			Window: tc.window,
+			Sort:   tc.sort,
+		}
+		res, err := s.handler.Find(s.ctx, q)
+		s.NoError(err, msg)
+		s.Equal(3, res.Total, msg)
+		names := []string{}
+		for _, item := range res.Items {
+			names = append(names, item.Payload["name"].(string))
+		}
+		s.Equal(tc.expect, names, msg)
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_SortBySingleField() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	cases := []struct {
+		sort   query.Sort
+		expect []string
+	}{
+		{query.Sort{{Name: "name"}}, []string{"Bob", "Jimmy", "Linda"}},
+		{query.Sort{{Name: "name", Reversed: true}}, []string{"Linda", "Jimmy", "Bob"}},
+		{query.Sort{{Name: "height"}}, []string{"Linda", "Jimmy", "Bob"}},
+		{query.Sort{{Name: "height", Reversed: true}}, []string{"Bob", "Jimmy", "Linda"}},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		q := &query.Query{
+			Window: &query.Window{Limit: -1},
+			Sort:   tc.sort,
+		}
+		res, err := s.handler.Find(s.ctx, q)
+		s.NoError(err, msg)
+		names := []string{}
+		for _, item := range res.Items {
+			names = append(names, item.Payload["name"].(string))
+		}
+		s.Equal(tc.expect, names, msg)
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_CorruptedItem() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	// damage an item
+	s.client.HSet("users:item:find_id2", "_types", "garbage")
+
+	// test single-field sort and sort by many fields
+	queries := []*query.Query{
+		{Window: &query.Window{Limit: -1}},
+		{Window: &query.Window{Limit: -1}, Sort: query.Sort{{Name: "age"}, {Name: "name"}}},
+	}
+	for i, q := range queries {
+		msg := fmt.Sprintf("Test case #%d", i)
+		res, err := s.handler.Find(s.ctx, q)
+		s.Nil(res, msg)
+		if s.IsType(&rds.CorruptedItemError{}, err, msg) {
+			s.Equal("users:item:find_id2", err.(*rds.CorruptedItemError).Key, msg)
+		}
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_CorruptedItemLenient() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	// damage an item
+	s.client.HSet("users:item:find_id2", "_types", "garbage")
+
+	var reported []string
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithLenientDecoding(func(key string, err error) {
+		reported = append(reported, key)
+		s.IsType(&rds.CorruptedItemError{}, err)
+	}))
+	s.Require().NoError(err)
+	res, err := handler.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}, Sort: query.Sort{{Name: "name"}}})
+	s.NoError(err)
+	s.Len(res.Items, 2)
+	s.Equal(2, res.Total)
+	s.Equal("find_id1", res.Items[0].ID)
+	s.Equal("find_id3", res.Items[1].ID)
+	s.Equal([]string{"users:item:find_id2"}, reported)
+	s.Equal([]string{"users:item:find_id2"}, s.client.SMembers("users:quarantine").Val())
+}
+
+func (s *RedisMainTestSuite) TestFind_HashTags() {
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithHashTags(true))
+	s.Require().NoError(err)
+	err = handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	// test all keys are hash-tagged
+	for _, k := range s.client.Keys("*").Val() {
+		s.True(strings.HasPrefix(k, "{users}:"), k)
+	}
+
+	// test single-field sort works without SORT patterns
+	q := &query.Query{
+		Window:    &query.Window{Limit: 2, Offset: 1},
+		Predicate: query.Predicate{&query.LowerThan{Field: "age", Value: 30}},
+		Sort:      query.Sort{{Name: "height", Reversed: true}},
+	}
+	res, err := handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Equal(3, res.Total)
+	s.Len(res.Items, 2)
+	s.Equal("find_id3", res.Items[0].ID)
+	s.Equal("find_id2", res.Items[1].ID)
+
+	// test no temporary keys are left
+	s.Len(s.client.Keys("{users}:tmp_*").Val(), 0)
+}
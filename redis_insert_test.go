@@ -1,10 +1,14 @@
 package rds_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/rs/rest-layer/schema/query"
 	"github.com/rs/rest-layer/resource"
+
+	rds "github.com/kolotaev/rest-layer-redis"
 )
 
 func (s *RedisMainTestSuite) TestInsert() {
@@ -98,3 +102,191 @@ func (s *RedisMainTestSuite) TestInsert_Duplicates() {
 	s.Equal("asdf", res.Items[0].ETag)
 	s.Equal("Bob", res.Items[0].Payload["name"])
 }
+
+func (s *RedisMainTestSuite) TestInsert_FieldsLayout() {
+	birth := time.Now()
+	item := &resource.Item{
+		ID:   "ins_id4",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":    35,
+			"birth":  birth,
+			"height": 185.54576,
+			"name":   "Bob",
+			"male":   true,
+		},
+	}
+
+	err := s.handler.Insert(s.ctx, []*resource.Item{item})
+	s.NoError(err)
+
+	// test every field is stored in its own hash field
+	stored := s.client.HGetAll("users:item:ins_id4").Val()
+	s.Equal("asdf", stored["_etag"])
+	s.Equal("35", stored["age"])
+	s.Equal("185.54576", stored["height"])
+	s.Equal("Bob", stored["name"])
+	s.Equal("true", stored["male"])
+	s.Equal("ins_id4", stored["id"])
+	s.Equal(fmt.Sprintf("%d", birth.UnixNano()), stored["birth"])
+	s.NotContains(stored, "payload")
+}
+
+func (s *RedisMainTestSuite) TestInsert_BlobLayout() {
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithLayout(rds.BlobLayout))
+	s.Require().NoError(err)
+	birth := time.Now()
+	item := &resource.Item{
+		ID:   "ins_id5",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":    35,
+			"birth":  birth,
+			"height": 185.54576,
+			"name":   "Bob",
+			"male":   true,
+		},
+	}
+
+	err = handler.Insert(s.ctx, []*resource.Item{item})
+	s.NoError(err)
+
+	// test the whole payload is stored in a single hash field
+	stored := s.client.HGetAll("users:item:ins_id5").Val()
+	s.Len(stored, 2)
+	s.Equal("asdf", stored["_etag"])
+	s.Contains(stored, "payload")
+
+	// test we can fetch it back
+	q := &query.Query{
+		Window:    &query.Window{Limit: 100},
+		Predicate: query.Predicate{&query.Equal{Field: "id", Value: "ins_id5"}},
+	}
+	res, err := handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Len(res.Items, 1)
+	s.Equal("ins_id5", res.Items[0].ID)
+	s.Equal("asdf", res.Items[0].ETag)
+	s.Equal(35, res.Items[0].Payload["age"])
+	s.Equal("Bob", res.Items[0].Payload["name"])
+	s.Equal(birth.Format(time.RFC3339Nano), res.Items[0].Payload["birth"].(time.Time).Format(time.RFC3339Nano))
+
+	// test items can't be sorted by fields they don't have in their hashes
+	q.Sort = query.Sort{{Name: "age"}}
+	_, err = handler.Find(s.ctx, q)
+	s.Equal(resource.ErrNotImplemented, err)
+}
+
+func (s *RedisMainTestSuite) TestInsert_Codecs() {
+	cases := []struct {
+		codec  rds.Codec
+		layout rds.Layout
+	}{
+		{rds.GobCodec, rds.BlobLayout},
+		{rds.JSONCodec, rds.BlobLayout},
+		{rds.MsgpackCodec, rds.BlobLayout},
+		{rds.GobCodec, rds.FieldsLayout},
+		{rds.JSONCodec, rds.FieldsLayout},
+		{rds.MsgpackCodec, rds.FieldsLayout},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		s.client.FlushAll()
+		handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithLayout(tc.layout), rds.WithCodec(tc.codec))
+		s.Require().NoError(err, msg)
+		updated := time.Now()
+		birth := time.Now()
+		item := &resource.Item{
+			ID:      "ins_id6",
+			ETag:    "asdf",
+			Updated: updated,
+			Payload: map[string]interface{}{
+				"age":    35,
+				"birth":  birth,
+				"height": 185.54576,
+				"name":   "Bob",
+				"male":   true,
+			},
+		}
+
+		err = handler.Insert(s.ctx, []*resource.Item{item})
+		s.NoError(err, msg)
+
+		q := &query.Query{
+			Window:    &query.Window{Limit: 100},
+			Predicate: query.Predicate{&query.Equal{Field: "id", Value: "ins_id6"}},
+		}
+		res, err := handler.Find(s.ctx, q)
+		s.NoError(err, msg)
+		s.Len(res.Items, 1, msg)
+		result := res.Items[0]
+		s.Equal("ins_id6", result.ID, msg)
+		s.Equal("asdf", result.ETag, msg)
+		s.Equal(updated.Format(time.RFC3339Nano), result.Updated.Format(time.RFC3339Nano), msg)
+		s.Equal(35, result.Payload["age"], msg)
+		s.Equal(185.54576, result.Payload["height"], msg)
+		s.Equal("Bob", result.Payload["name"], msg)
+		s.Equal(true, result.Payload["male"], msg)
+		s.IsType(time.Time{}, result.Payload["birth"], msg)
+		s.True(birth.Equal(result.Payload["birth"].(time.Time)), msg)
+	}
+}
+
+func (s *RedisMainTestSuite) TestInsert_JSONCodecIsReadable() {
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithLayout(rds.BlobLayout), rds.WithCodec(rds.JSONCodec))
+	s.Require().NoError(err)
+	item := &resource.Item{
+		ID:   "ins_id7",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  35,
+			"name": "Bob",
+		},
+	}
+
+	err = handler.Insert(s.ctx, []*resource.Item{item})
+	s.NoError(err)
+
+	stored := s.client.HGet("users:item:ins_id7", "payload").Val()
+	payload := make(map[string]interface{})
+	s.NoError(json.Unmarshal([]byte(stored), &payload))
+	s.Equal("Bob", payload["name"])
+	s.Equal(35.0, payload["age"])
+}
+
+func (s *RedisMainTestSuite) TestInsert_DuplicatesInBatch() {
+	items := getPersons()
+	err := s.handler.Insert(s.ctx, items[:1])
+	s.NoError(err)
+
+	// test nothing is written if any of the items exists
+	err = s.handler.Insert(s.ctx, items)
+	s.EqualError(err, "Conflict")
+	s.Equal(int64(0), s.client.Exists("users:item:find_id2", "users:item:find_id3").Val())
+	s.Equal([]string{"users:item:find_id1"}, s.client.SMembers("users:ids").Val())
+	s.Equal([]string{"users:item:find_id1"}, s.client.SMembers("users:set:name:Bob").Val())
+	s.Len(s.client.ZRange("users:zset:age", 0, -1).Val(), 1)
+
+	// test the same ID twice in a batch
+	err = s.handler.Insert(s.ctx, []*resource.Item{items[1], items[1]})
+	s.EqualError(err, "Conflict")
+	s.Equal(int64(0), s.client.Exists("users:item:find_id2").Val())
+}
+
+func (s *RedisMainTestSuite) TestInsert_Concurrent() {
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- s.handler.Insert(s.ctx, getPersons()[:1])
+		}()
+	}
+	conflicts := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			s.EqualError(err, "Conflict")
+			conflicts++
+		}
+	}
+	s.Equal(n-1, conflicts)
+}
@@ -0,0 +1,29 @@
+package rds_test
+
+import (
+	"github.com/go-redis/redis"
+)
+
+func (s *RedisMainTestSuite) TestDeleteTemporaryKeys() {
+	s.NoError(s.client.SAdd("users:tmp_1_2", "users:item:1").Err())
+	s.NoError(s.client.ZAdd("users:tmp_3_4", redis.Z{Score: 1, Member: "users:item:1"}).Err())
+	// not temporary keys
+	s.NoError(s.client.HSet("users:tmp_5_6", "name", "Bob").Err())
+	s.NoError(s.client.SAdd("users:tmp_x", "users:item:1").Err())
+	s.NoError(s.client.SAdd("users:tmp_7_8:idx_non_sorted", "users:name:Bob").Err())
+	s.NoError(s.client.SAdd("people:tmp_1_2", "people:item:1").Err())
+	// keys of the earlier versions have no prefix
+	s.NoError(s.client.ZAdd("tmp_5577006791947779410_1557312323423", redis.Z{Score: 1, Member: "users:1"}).Err())
+	s.NoError(s.client.SAdd("tmp_x", "users:1").Err())
+
+	n, err := s.handler.DeleteTemporaryKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(3, n)
+	s.ElementsMatch(
+		[]string{"users:tmp_5_6", "users:tmp_x", "users:tmp_7_8:idx_non_sorted", "people:tmp_1_2", "tmp_x"},
+		s.client.Keys("*").Val())
+
+	n, err = s.handler.DeleteTemporaryKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(0, n)
+}
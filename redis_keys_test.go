@@ -0,0 +1,215 @@
+package rds_test
+
+import (
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+func (s *RedisMainTestSuite) TestKeys_NoCollisions() {
+	items := []*resource.Item{
+		// IDs that are the same as names of other keys with PlainKeys
+		{ID: "age", ETag: "a", Payload: map[string]interface{}{"name": "a:b", "age": 1}},
+		{ID: "all_ids", ETag: "a", Payload: map[string]interface{}{"name": "*", "age": 2}},
+		// ID with a separator
+		{ID: "x:y", ETag: "a", Payload: map[string]interface{}{"name": "a", "age": 3}},
+	}
+	err := s.handler.Insert(s.ctx, items)
+	s.NoError(err)
+
+	cases := []struct {
+		predicate query.Predicate
+		want      []string
+	}{
+		{nil, []string{"age", "all_ids", "x:y"}},
+		{query.Predicate{&query.Equal{Field: "name", Value: "a"}}, []string{"x:y"}},
+		{query.Predicate{&query.Equal{Field: "name", Value: "a:b"}}, []string{"age"}},
+		{query.Predicate{&query.Equal{Field: "name", Value: "*"}}, []string{"all_ids"}},
+		{query.Predicate{&query.Equal{Field: "id", Value: "x:y"}}, []string{"x:y"}},
+		{query.Predicate{&query.GreaterThan{Field: "age", Value: 1}}, []string{"all_ids", "x:y"}},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		ids := s.findIDs(s.handler, &query.Query{
+			Window:    &query.Window{Limit: -1},
+			Predicate: tc.predicate,
+			Sort:      query.Sort{{Name: "age"}},
+		}, msg)
+		s.Equal(tc.want, ids, msg)
+	}
+
+	s.NoError(s.handler.Delete(s.ctx, items[2]))
+	res, err := s.handler.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}})
+	s.NoError(err)
+	s.Equal(2, res.Total)
+}
+
+func (s *RedisMainTestSuite) TestKeys_Registry() {
+	persons := getPersons()
+	err := s.handler.Insert(s.ctx, persons)
+	s.NoError(err)
+	s.ElementsMatch(
+		[]string{"users:set:name:Bob", "users:set:name:Linda", "users:set:name:Jimmy"},
+		s.client.SMembers("users:set:name").Val())
+
+	// test a value is unregistered when no items have it anymore
+	bob := persons[0]
+	updated := &resource.Item{ID: bob.ID, ETag: "new", Payload: map[string]interface{}{"name": "Jimmy", "age": 20}}
+	s.NoError(s.handler.Update(s.ctx, updated, bob))
+	s.ElementsMatch(
+		[]string{"users:set:name:Linda", "users:set:name:Jimmy"},
+		s.client.SMembers("users:set:name").Val())
+
+	s.NoError(s.handler.Delete(s.ctx, updated))
+	s.ElementsMatch(
+		[]string{"users:set:name:Linda", "users:set:name:Jimmy"},
+		s.client.SMembers("users:set:name").Val())
+
+	_, err = s.handler.Clear(s.ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "name", Value: "Jimmy"}}})
+	s.NoError(err)
+	s.Equal([]string{"users:set:name:Linda"}, s.client.SMembers("users:set:name").Val())
+
+	// test registries are not maintained with PlainKeys
+	plain, err := rds.NewHandler(s.client, "plain", userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	s.NoError(plain.Insert(s.ctx, getPersons()))
+	s.Equal(int64(0), s.client.Exists("plain:name").Val())
+}
+
+func (s *RedisMainTestSuite) TestMigrateKeys() {
+	// items are stored as the earlier versions did it
+	plain, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithKeyEncoding(rds.PlainKeys),
+		rds.WithLayout(rds.BlobLayout))
+	s.Require().NoError(err)
+	err = plain.Insert(s.ctx, getPersons())
+	s.NoError(err)
+	s.Equal(int64(1), s.client.Exists("users:find_id1").Val())
+	s.True(s.client.HExists("users:find_id1", "payload").Val())
+	// the marker would take the key of an item with PlainKeys
+	s.Equal(int64(0), s.client.Exists("users:keys_version").Val())
+
+	// test items stored with plain keys are not taken for missing with escaped ones
+	escaped, err := rds.NewHandler(s.client, usersEntity, userSchema)
+	s.Require().NoError(err)
+	all := &query.Query{Window: &query.Window{Limit: -1}}
+	_, err = escaped.Find(s.ctx, all)
+	s.IsType(&rds.KeysMismatchError{}, err)
+	s.Contains(err.Error(), "MigrateKeys")
+	// nor duplicated
+	err = escaped.Insert(s.ctx, getPersons()[:1])
+	s.IsType(&rds.KeysMismatchError{}, err)
+
+	n, err := s.handler.MigrateKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(3, n)
+
+	// test only escaped keys are left and the items are stored with the handler's layout
+	s.Equal("2:fields", s.client.Get("users:keys_version").Val())
+	s.False(s.client.HExists("users:item:find_id1", "payload").Val())
+	s.Equal("Bob", s.client.HGet("users:item:find_id1", "name").Val())
+	s.Equal(int64(0), s.client.Exists("users:find_id1", "users:all_ids", "users:name:Bob", "users:age").Val())
+	res, err := escaped.Find(s.ctx, all)
+	s.NoError(err)
+	s.Equal(3, res.Total)
+	res, err = escaped.Find(s.ctx, &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "age", Value: 19}, &query.Equal{Field: "name", Value: "Bob"}},
+	})
+	s.NoError(err)
+	s.Len(res.Items, 1)
+	s.Equal("find_id1", res.Items[0].ID)
+	s.Equal("asdf", res.Items[0].ETag)
+
+	// test the migration can be run again
+	n, err = s.handler.MigrateKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(0, n)
+
+	_, err = plain.MigrateKeys(s.ctx)
+	s.Error(err)
+}
+
+func (s *RedisMainTestSuite) TestMigrateKeys_Interrupted() {
+	plain, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	escaped, err := rds.NewHandler(s.client, usersEntity, userSchema)
+	s.Require().NoError(err)
+	persons := getPersons()
+
+	// emulate an item that was moved, but not deleted with the old keys
+	err = escaped.Insert(s.ctx, persons[:1])
+	s.NoError(err)
+	s.client.Del("users:keys_version")
+	err = plain.Insert(s.ctx, persons)
+	s.NoError(err)
+
+	n, err := escaped.MigrateKeys(s.ctx)
+	s.NoError(err)
+	s.Equal(3, n)
+	s.Equal(int64(0), s.client.Exists("users:all_ids").Val())
+
+	// test a different item stored with both keys is not lost
+	s.client.Del("users:keys_version")
+	err = plain.Insert(s.ctx, persons[1:2])
+	s.NoError(err)
+	s.client.Set("users:keys_version", "2:fields", 0)
+	persons[1].ETag = "other"
+	err = escaped.Update(s.ctx, persons[1], getPersons()[1])
+	s.NoError(err)
+	_, err = escaped.MigrateKeys(s.ctx)
+	s.Error(err)
+	s.Equal(int64(1), s.client.Exists("users:find_id2").Val())
+}
+
+func (s *RedisMainTestSuite) TestKeys_Mismatch() {
+	s.NoError(s.handler.Insert(s.ctx, getPersons()))
+
+	cases := []struct {
+		opts []rds.Option
+		ok   bool
+	}{
+		{nil, true},
+		{[]rds.Option{rds.WithLayout(rds.BlobLayout)}, false},
+		{[]rds.Option{rds.WithKeyEncoding(rds.PlainKeys)}, false},
+	}
+	for i, tc := range cases {
+		msg := fmt.Sprintf("Test case #%d", i)
+		handler, err := rds.NewHandler(s.client, usersEntity, userSchema, tc.opts...)
+		s.Require().NoError(err, msg)
+		_, err = handler.Find(s.ctx, &query.Query{})
+		if tc.ok {
+			s.NoError(err, msg)
+		} else {
+			s.IsType(&rds.KeysMismatchError{}, err, msg)
+		}
+	}
+
+	// test an item may have the ID of the marker with PlainKeys
+	plain, err := rds.NewHandler(s.client, "plain", userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	item := &resource.Item{ID: "keys_version", ETag: "a", Payload: map[string]interface{}{"name": "Bob", "age": 1}}
+	s.NoError(plain.Insert(s.ctx, []*resource.Item{item}))
+	res, err := plain.Find(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Require().Len(res.Items, 1)
+	s.Equal("keys_version", res.Items[0].ID)
+
+	// test keyspaces without the marker are checked once as well
+	escaped, err := rds.NewHandler(s.client, "empty", userSchema)
+	s.Require().NoError(err)
+	plain, err = rds.NewHandler(s.client, "empty_plain", userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	for _, h := range []*rds.Handler{escaped, plain} {
+		_, err = h.Find(s.ctx, &query.Query{})
+		s.NoError(err)
+	}
+	s.client.SAdd("empty:all_ids", "empty:1")
+	s.client.Set("empty_plain:keys_version", "2:fields", 0)
+	for _, h := range []*rds.Handler{escaped, plain} {
+		_, err = h.Find(s.ctx, &query.Query{})
+		s.NoError(err)
+	}
+}
@@ -0,0 +1,69 @@
+package rds_test
+
+import (
+	"github.com/rs/rest-layer/resource"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+// check the handler is used by rest-layer for multi gets
+var _ resource.MultiGetter = rds.Handler{}
+
+func (s *RedisMainTestSuite) TestMultiGet() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	items, err := s.handler.MultiGet(s.ctx, []interface{}{"find_id3", "missing", "find_id1"})
+	s.NoError(err)
+	s.Len(items, 2)
+	s.Equal("find_id3", items[0].ID)
+	s.Equal("Jimmy", items[0].Payload["name"])
+	s.Equal(19, items[0].Payload["age"])
+	s.Equal("asdfq", items[0].ETag)
+	s.Equal("find_id1", items[1].ID)
+	s.Equal("Bob", items[1].Payload["name"])
+
+	items, err = s.handler.MultiGet(s.ctx, []interface{}{"missing"})
+	s.NoError(err)
+	s.Empty(items)
+
+	items, err = s.handler.MultiGet(s.ctx, nil)
+	s.NoError(err)
+	s.Empty(items)
+}
+
+func (s *RedisMainTestSuite) TestMultiGet_Resource() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	// test rest-layer puts nil in places of missing items
+	index := resource.NewIndex()
+	users := index.Bind("users", userSchema, s.handler, resource.DefaultConf)
+	items, err := users.MultiGet(s.ctx, []interface{}{"find_id2", "missing", "find_id1"})
+	s.NoError(err)
+	s.Len(items, 3)
+	s.Equal("find_id2", items[0].ID)
+	s.Nil(items[1])
+	s.Equal("find_id1", items[2].ID)
+
+	_, err = users.Get(s.ctx, "missing")
+	s.Equal(resource.ErrNotFound, err)
+}
+
+func (s *RedisMainTestSuite) TestMultiGet_CorruptedItem() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+	s.NoError(s.client.HSet("users:item:find_id2", "age", "not a number").Err())
+
+	_, err = s.handler.MultiGet(s.ctx, []interface{}{"find_id1", "find_id2"})
+	s.Error(err)
+	s.IsType(&rds.CorruptedItemError{}, err)
+
+	lenient, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithLenientDecoding(nil))
+	s.Require().NoError(err)
+	items, err := lenient.MultiGet(s.ctx, []interface{}{"find_id1", "find_id2"})
+	s.NoError(err)
+	s.Len(items, 1)
+	s.Equal("find_id1", items[0].ID)
+	s.Equal([]string{"users:item:find_id2"}, s.client.SMembers("users:quarantine").Val())
+}
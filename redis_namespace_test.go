@@ -0,0 +1,55 @@
+package rds_test
+
+import (
+	"strings"
+
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+func (s *RedisMainTestSuite) TestNamespace() {
+	billing, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithNamespace("billing"))
+	s.Require().NoError(err)
+	shop, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithNamespace("shop"))
+	s.Require().NoError(err)
+
+	persons := getPersons()
+	err = billing.Insert(s.ctx, persons)
+	s.NoError(err)
+	// test the same IDs don't conflict in different namespaces
+	err = shop.Insert(s.ctx, persons[:1])
+	s.NoError(err)
+
+	// test all keys live under the namespaces
+	for _, k := range s.client.Keys("*").Val() {
+		s.True(strings.HasPrefix(k, "billing:users:") || strings.HasPrefix(k, "shop:users:"), k)
+	}
+
+	// test each handler sees only its own items, with and without predicates
+	queries := []*query.Query{
+		{Window: &query.Window{Limit: -1}},
+		{Window: &query.Window{Limit: -1}, Predicate: query.Predicate{&query.Equal{Field: "name", Value: "Bob"}}},
+		{Window: &query.Window{Limit: -1}, Predicate: query.Predicate{&query.GreaterOrEqual{Field: "age", Value: 0}}},
+	}
+	for _, q := range queries {
+		res, err := billing.Find(s.ctx, q)
+		s.NoError(err)
+		s.NotZero(res.Total)
+		res, err = shop.Find(s.ctx, q)
+		s.NoError(err)
+		s.Equal(1, res.Total)
+	}
+	res, err := s.handler.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}})
+	s.NoError(err)
+	s.Equal(0, res.Total)
+
+	// test clear doesn't touch another namespace
+	n, err := shop.Clear(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Equal(1, n)
+	res, err = billing.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}})
+	s.NoError(err)
+	s.Equal(3, res.Total)
+	s.Equal([]string{"shop:users:keys_version"}, s.client.Keys("shop:*").Val())
+}
@@ -0,0 +1,111 @@
+package rds_test
+
+import (
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+var articleSchema = schema.Schema{
+	Fields: schema.Fields{
+		"id": schema.IDField,
+		"meta": {
+			Schema: &schema.Schema{
+				Fields: schema.Fields{
+					"title": {
+						Filterable: true,
+						Sortable:   true,
+						Validator:  &schema.String{},
+					},
+					"stats": {
+						Validator: &schema.Object{
+							Schema: &schema.Schema{
+								Fields: schema.Fields{
+									"views": {
+										Filterable: true,
+										Sortable:   true,
+										Validator:  &schema.Integer{},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func getArticles() []*resource.Item {
+	return []*resource.Item{
+		{ID: "art1", ETag: "a", Payload: map[string]interface{}{"id": "art1", "meta": map[string]interface{}{
+			"title": "Redis", "stats": map[string]interface{}{"views": 30},
+		}}},
+		{ID: "art2", ETag: "b", Payload: map[string]interface{}{"id": "art2", "meta": map[string]interface{}{
+			"title": "Go", "stats": map[string]interface{}{"views": 10},
+		}}},
+		{ID: "art3", ETag: "c", Payload: map[string]interface{}{"id": "art3", "meta": map[string]interface{}{
+			"title": "Lua",
+		}}},
+	}
+}
+
+func (s *RedisMainTestSuite) TestFind_Nested() {
+	handler, err := rds.NewHandler(s.client, "articles", articleSchema)
+	s.Require().NoError(err)
+	articles := getArticles()
+	s.NoError(handler.Insert(s.ctx, articles))
+
+	// test can filter by a field of a nested object
+	q := &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "meta.title", Value: "Go"}},
+	}
+	s.Equal([]string{"art2"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.In{Field: "meta.title", Values: []query.Value{"Go", "Lua"}}}
+	q.Sort = query.Sort{{Name: "meta.title"}}
+	s.Equal([]string{"art2", "art3"}, s.findIDs(handler, q))
+
+	// test can filter by a field of an object nested deeper
+	q = &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.GreaterThan{Field: "meta.stats.views", Value: 20}},
+	}
+	s.Equal([]string{"art1"}, s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.NotExist{Field: "meta.stats.views"}}
+	s.Equal([]string{"art3"}, s.findIDs(handler, q))
+
+	// test can sort by fields of nested objects
+	q = &query.Query{Window: &query.Window{Limit: -1}, Sort: query.Sort{{Name: "meta.title", Reversed: true}}}
+	s.Equal([]string{"art1", "art3", "art2"}, s.findIDs(handler, q))
+	q.Sort = query.Sort{{Name: "meta.stats.views"}, {Name: "meta.title"}}
+	s.Equal([]string{"art3", "art2", "art1"}, s.findIDs(handler, q))
+
+	// test nested values are restored along with their objects
+	res, err := handler.Find(s.ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "meta.title", Value: "Redis"}}})
+	s.NoError(err)
+	s.Require().Len(res.Items, 1)
+	s.Equal(articles[0].Payload["meta"], res.Items[0].Payload["meta"])
+
+	// test the indices are updated along with items
+	updated := &resource.Item{ID: "art2", ETag: "new", Payload: map[string]interface{}{"id": "art2", "meta": map[string]interface{}{
+		"title": "Zig", "stats": map[string]interface{}{"views": 50},
+	}}}
+	s.NoError(handler.Update(s.ctx, updated, articles[1]))
+	q = &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "meta.title", Value: "Go"}},
+	}
+	s.Empty(s.findIDs(handler, q))
+	q.Predicate = query.Predicate{&query.GreaterThan{Field: "meta.stats.views", Value: 20}}
+	q.Sort = query.Sort{{Name: "meta.stats.views"}}
+	s.Equal([]string{"art1", "art2"}, s.findIDs(handler, q))
+	q = &query.Query{Window: &query.Window{Limit: -1}, Sort: query.Sort{{Name: "meta.title", Reversed: true}}}
+	s.Equal([]string{"art2", "art1", "art3"}, s.findIDs(handler, q))
+
+	_, err = handler.Clear(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Equal([]string{"articles:keys_version"}, s.client.Keys("*").Val())
+}
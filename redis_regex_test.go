@@ -0,0 +1,117 @@
+package rds_test
+
+import (
+	"regexp"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+func (s *RedisMainTestSuite) TestFind_Regex() {
+	persons := getPersons()
+	persons = append(persons, &resource.Item{
+		ID:      "find_id4",
+		ETag:    "a",
+		Payload: map[string]interface{}{"name": "Jo:hn* [Jr]", "age": 40},
+	})
+	err := s.handler.Insert(s.ctx, persons)
+	s.NoError(err)
+
+	regex := func(field, expr string, negated bool) *query.Regex {
+		return &query.Regex{Field: field, Value: regexp.MustCompile(expr), Negated: negated}
+	}
+	q := &query.Query{Window: &query.Window{Limit: -1}, Sort: query.Sort{{Name: "name"}}}
+
+	// test can find by prefix
+	q.Predicate = query.Predicate{regex("name", "^J", false)}
+	s.Equal([]string{"find_id3", "find_id4"}, s.findIDs(s.handler, q))
+	n, err := s.handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(2, n)
+
+	// test flags and alternations are supported
+	q.Predicate = query.Predicate{regex("name", "(?i)^b|in", false)}
+	s.Equal([]string{"find_id1", "find_id2"}, s.findIDs(s.handler, q))
+
+	// test values with the characters escaped in keys are matched unescaped
+	q.Predicate = query.Predicate{regex("name", `o:h.*\[`, false)}
+	s.Equal([]string{"find_id4"}, s.findIDs(s.handler, q))
+
+	// test nothing is found if no value matches
+	q.Predicate = query.Predicate{regex("name", "^x", false)}
+	s.Empty(s.findIDs(s.handler, q))
+	n, err = s.handler.Count(s.ctx, q)
+	s.NoError(err)
+	s.Equal(0, n)
+
+	// test negated regex
+	q.Predicate = query.Predicate{regex("name", "^J", true)}
+	s.Equal([]string{"find_id1", "find_id2"}, s.findIDs(s.handler, q))
+
+	// test regex is combined with other filters
+	q.Predicate = query.Predicate{regex("name", "^J", false), &query.LowerThan{Field: "age", Value: 30}}
+	s.Equal([]string{"find_id3"}, s.findIDs(s.handler, q))
+	q.Predicate = query.Predicate{&query.Or{regex("name", "^B", false), regex("name", "^L", false)}}
+	s.Equal([]string{"find_id1", "find_id2"}, s.findIDs(s.handler, q))
+
+	// test Clear deletes the matching items
+	n, err = s.handler.Clear(s.ctx, &query.Query{Predicate: query.Predicate{regex("name", "^J", false)}})
+	s.NoError(err)
+	s.Equal(2, n)
+	n, err = s.handler.Count(s.ctx, &query.Query{})
+	s.NoError(err)
+	s.Equal(2, n)
+}
+
+func (s *RedisMainTestSuite) TestFind_RegexScanLimit() {
+	err := s.handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+	q := &query.Query{Predicate: query.Predicate{&query.Regex{Field: "name", Value: regexp.MustCompile("^J")}}}
+
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithRegexScanLimit(2))
+	s.Require().NoError(err)
+	_, err = handler.Find(s.ctx, q)
+	s.Equal(rds.ErrRegexScanLimit, err)
+	// it's the client's error
+	s.Equal(422, rest.NewError(err).Code)
+
+	handler, err = rds.NewHandler(s.client, usersEntity, userSchema, rds.WithRegexScanLimit(3))
+	s.Require().NoError(err)
+	res, err := handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Equal(1, res.Total)
+
+	// values of fields are not registered with PlainKeys
+	handler, err = rds.NewHandler(s.client, "plain", userSchema, rds.WithKeyEncoding(rds.PlainKeys))
+	s.Require().NoError(err)
+	_, err = handler.Find(s.ctx, q)
+	s.Equal(resource.ErrNotImplemented, err)
+}
+
+func (s *RedisMainTestSuite) TestFind_RegexElemMatch() {
+	handler, err := rds.NewHandler(s.client, "posts", postSchema)
+	s.Require().NoError(err)
+	s.NoError(handler.Insert(s.ctx, getPosts()))
+
+	// test regex is matched against the values of the elements' field
+	q := &query.Query{Window: &query.Window{Limit: -1}, Predicate: query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Regex{Field: "author", Value: regexp.MustCompile("^A")},
+	}}}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+
+	// test regex and the other filters apply to the same element
+	q.Predicate = query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Regex{Field: "author", Value: regexp.MustCompile("^B")},
+		&query.GreaterThan{Field: "likes", Value: 3},
+	}}}
+	s.Equal([]string{"post2"}, s.findIDs(handler, q))
+
+	// test negated regex
+	q.Predicate = query.Predicate{&query.ElemMatch{Field: "comments", Exps: []query.Expression{
+		&query.Regex{Field: "author", Value: regexp.MustCompile("^B"), Negated: true},
+	}}}
+	s.Equal([]string{"post1"}, s.findIDs(handler, q))
+}
@@ -0,0 +1,50 @@
+package rds_test
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+func (s *RedisMainTestSuite) TestReplicas() {
+	// a replica that is behind: it's a different database of the same server
+	replica := redis.NewClient(&redis.Options{Addr: redisAddress, DB: 1})
+	defer replica.Close()
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithReplicas(replica))
+	s.Require().NoError(err)
+
+	err = handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+	s.Equal(int64(3), s.client.SCard("users:ids").Val())
+	s.Equal(int64(0), replica.Exists("users:ids").Val())
+
+	q := &query.Query{Window: &query.Window{Limit: -1}}
+	res, err := handler.Find(s.ctx, q)
+	s.NoError(err)
+	s.Equal(0, res.Total)
+
+	// test reads from the primary can be forced
+	res, err = handler.Find(rds.ReadFromPrimary(s.ctx), q)
+	s.NoError(err)
+	s.Equal(3, res.Total)
+}
+
+func (s *RedisMainTestSuite) TestReplicas_Fallback() {
+	unavailable := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+	defer unavailable.Close()
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema, rds.WithReplicas(unavailable))
+	s.Require().NoError(err)
+
+	err = handler.Insert(s.ctx, getPersons())
+	s.NoError(err)
+
+	res, err := handler.Find(s.ctx, &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "age", Value: 19}},
+	})
+	s.NoError(err)
+	s.Equal(2, res.Total)
+}
@@ -0,0 +1,73 @@
+package rds_test
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+
+	rds "github.com/kolotaev/rest-layer-redis"
+)
+
+type tenantKey struct{}
+
+func tenantFromContext(ctx context.Context) (string, error) {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant, nil
+}
+
+func (s *RedisMainTestSuite) TestTenant() {
+	handler, err := rds.NewHandler(s.client, usersEntity, userSchema,
+		rds.WithNamespace("billing"), rds.WithTenant(tenantFromContext))
+	s.Require().NoError(err)
+	acme := context.WithValue(s.ctx, tenantKey{}, "acme")
+	globex := context.WithValue(s.ctx, tenantKey{}, "globex")
+
+	persons := getPersons()
+	err = handler.Insert(acme, persons)
+	s.NoError(err)
+	// test the same IDs don't conflict for different tenants
+	err = handler.Insert(globex, persons[:1])
+	s.NoError(err)
+
+	// test all keys are scoped to the tenants
+	for _, k := range s.client.Keys("*").Val() {
+		s.True(strings.HasPrefix(k, "billing:acme:users:") || strings.HasPrefix(k, "billing:globex:users:"), k)
+	}
+
+	// test each tenant sees only its own items
+	all := &query.Query{Window: &query.Window{Limit: -1}}
+	res, err := handler.Find(acme, all)
+	s.NoError(err)
+	s.Equal(3, res.Total)
+	res, err = handler.Find(globex, all)
+	s.NoError(err)
+	s.Equal(1, res.Total)
+	res, err = handler.Find(globex, &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "name", Value: "Linda"}},
+	})
+	s.NoError(err)
+	s.Equal(0, res.Total)
+
+	// test a tenant can't update or delete an item of another one
+	linda := persons[1]
+	updated := &resource.Item{ID: linda.ID, ETag: "new", Payload: map[string]interface{}{"name": "Lin"}}
+	s.EqualError(handler.Update(globex, updated, linda), "Not Found")
+	s.EqualError(handler.Delete(globex, linda), "Not Found")
+	s.NoError(handler.Update(acme, updated, linda))
+
+	// test clear doesn't touch another tenant
+	n, err := handler.Clear(globex, &query.Query{})
+	s.NoError(err)
+	s.Equal(1, n)
+	res, err = handler.Find(acme, all)
+	s.NoError(err)
+	s.Equal(3, res.Total)
+
+	// test requests without a tenant fail
+	_, err = handler.Find(s.ctx, all)
+	s.Equal(rds.ErrNoTenant, err)
+	s.Equal(rds.ErrNoTenant, handler.Insert(s.ctx, persons))
+}
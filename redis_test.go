@@ -78,7 +78,10 @@ func (s *RedisMainTestSuite) SetupSuite() {
 		s.T().Fatal(err)
 	}
 
-	s.handler = rds.NewHandler(s.client, usersEntity, userSchema)
+	s.handler, err = rds.NewHandler(s.client, usersEntity, userSchema)
+	if err != nil {
+		s.T().Fatal(err)
+	}
 	s.ctx = context.Background()
 }
 
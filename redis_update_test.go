@@ -1,6 +1,7 @@
 package rds_test
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/rs/rest-layer/schema/query"
@@ -118,3 +119,98 @@ func (s *RedisMainTestSuite) TestUpdate_Conflict() {
 	s.Equal(true, result.Payload["male"])
 	s.Equal("upd_id1", result.Payload["id"])
 }
+
+func (s *RedisMainTestSuite) TestUpdate_NotFound() {
+	bob := &resource.Item{
+		ID:   "upd_id2",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  35,
+			"name": "Bob",
+		},
+	}
+
+	err := s.handler.Update(s.ctx, bob, bob)
+	s.EqualError(err, "Not Found")
+	s.Zero(s.client.DbSize().Val())
+}
+
+func (s *RedisMainTestSuite) TestUpdate_ReplacesIndices() {
+	bob := &resource.Item{
+		ID:   "upd_id3",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  35,
+			"name": "Bob",
+		},
+	}
+	err := s.handler.Insert(s.ctx, []*resource.Item{bob})
+	s.NoError(err)
+
+	bobUpdated := &resource.Item{
+		ID:   "upd_id3",
+		ETag: "asdf2",
+		Payload: map[string]interface{}{
+			"name": "Robert",
+		},
+	}
+	err = s.handler.Update(s.ctx, bobUpdated, bob)
+	s.NoError(err)
+
+	// test old values are not found anymore
+	for _, p := range []query.Predicate{
+		{&query.Equal{Field: "name", Value: "Bob"}},
+		{&query.Equal{Field: "age", Value: 35}},
+	} {
+		res, err := s.handler.Find(s.ctx, &query.Query{Window: &query.Window{Limit: -1}, Predicate: p})
+		s.NoError(err)
+		s.Len(res.Items, 0)
+	}
+	s.Equal(int64(0), s.client.Exists("users:set:name:Bob").Val())
+	s.Equal(int64(0), s.client.Exists("users:zset:age").Val())
+
+	// test new values are found
+	res, err := s.handler.Find(s.ctx, &query.Query{
+		Window:    &query.Window{Limit: -1},
+		Predicate: query.Predicate{&query.Equal{Field: "name", Value: "Robert"}},
+	})
+	s.NoError(err)
+	s.Len(res.Items, 1)
+	s.Equal("asdf2", res.Items[0].ETag)
+}
+
+func (s *RedisMainTestSuite) TestUpdate_Concurrent() {
+	bob := &resource.Item{
+		ID:   "upd_id4",
+		ETag: "asdf",
+		Payload: map[string]interface{}{
+			"age":  35,
+			"name": "Bob",
+		},
+	}
+	err := s.handler.Insert(s.ctx, []*resource.Item{bob})
+	s.NoError(err)
+
+	// test only one of the writers that have seen the same ETag succeeds
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			updated := &resource.Item{
+				ID:      "upd_id4",
+				ETag:    fmt.Sprintf("etag%d", i),
+				Payload: map[string]interface{}{"age": i},
+			}
+			errs <- s.handler.Update(s.ctx, updated, bob)
+		}(i)
+	}
+	conflicts := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			s.EqualError(err, "Conflict")
+			conflicts++
+		}
+	}
+	s.Equal(n-1, conflicts)
+	s.Equal(int64(1), s.client.ZCard("users:zset:age").Val())
+}
@@ -0,0 +1,109 @@
+package rds
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// defaultRegexScanLimit is a number of values of a field a regex is matched against by default.
+const defaultRegexScanLimit = 10000
+
+// ErrRegexScanLimit is returned when a regex filter is applied to a field that has more values
+// than the handler is allowed to scan (see WithRegexScanLimit). It's a client's error: the API responds
+// with 422 Unprocessable Entity, the client should narrow the regex filter down with other filters.
+var ErrRegexScanLimit = &rest.Error{Code: http.StatusUnprocessableEntity, Message: "Too many values to match a regex against"}
+
+// resolveRegexes returns a copy of a predicate where regex filters are replaced with In (or NotIn if negated)
+// filters by the values of the fields they match. Redis can't match regexes, so values of a field are read
+// from its registry (see keyspace.registry) and matched in Go.
+// Registries are maintained only with EscapedKeys, regex filters are not supported otherwise.
+// Regex filters of ElemMatch are matched against the values of the elements' fields (see keyspace.elements).
+func (h Handler) resolveRegexes(ctx context.Context, ks keyspace, predicate query.Predicate) (query.Predicate, error) {
+	result := make(query.Predicate, 0, len(predicate))
+	for _, exp := range predicate {
+		switch t := exp.(type) {
+		case *query.And:
+			sub, err := h.resolveRegexes(ctx, ks, query.Predicate(*t))
+			if err != nil {
+				return nil, err
+			}
+			and := query.And(sub)
+			exp = &and
+		case *query.Or:
+			sub, err := h.resolveRegexes(ctx, ks, query.Predicate(*t))
+			if err != nil {
+				return nil, err
+			}
+			or := query.Or(sub)
+			exp = &or
+		case *query.ElemMatch:
+			eks, ok := ks.elements(t.Field)
+			if !ok {
+				// Not supported by translatePredicate either
+				break
+			}
+			sub, err := h.resolveRegexes(ctx, eks, query.Predicate(t.Exps))
+			if err != nil {
+				return nil, err
+			}
+			exp = &query.ElemMatch{Field: t.Field, Exps: sub}
+		case *query.Regex:
+			values, err := h.matchRegex(ctx, ks, t)
+			if err != nil {
+				return nil, err
+			}
+			if t.Negated {
+				exp = &query.NotIn{Field: t.Field, Values: values}
+			} else {
+				exp = &query.In{Field: t.Field, Values: values}
+			}
+		}
+		result = append(result, exp)
+	}
+	return result, nil
+}
+
+// matchRegex returns the values of a field that match a regex filter.
+// Values are scanned from the field's registry, ErrRegexScanLimit is returned if there are too many of them.
+func (h Handler) matchRegex(ctx context.Context, ks keyspace, r *query.Regex) ([]query.Value, error) {
+	registry := ks.registry(r.Field)
+	if registry == "" {
+		return nil, resource.ErrNotImplemented
+	}
+	// Keys of the set indices are the registry key followed by the escaped values
+	prefix := registry + ":"
+
+	var values []query.Value
+	exceeded := false
+	err := h.read(ctx, func(c redis.Cmdable) error {
+		values, exceeded = nil, false
+		// SSCAN may return a value more than once
+		seen := make(map[string]bool)
+		iter := c.SScan(registry, 0, "", scanCount).Iterator()
+		for iter.Next() {
+			value := unescapeKeyPart(strings.TrimPrefix(iter.Val(), prefix))
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			if len(seen) > h.regexScanLimit {
+				exceeded = true
+				return nil
+			}
+			if r.Value.MatchString(value) {
+				values = append(values, value)
+			}
+		}
+		return iter.Err()
+	})
+	if err == nil && exceeded {
+		err = ErrRegexScanLimit
+	}
+	return values, err
+}
@@ -0,0 +1,47 @@
+package rds
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/go-redis/redis"
+)
+
+// replicaPool is a set of clients connected to read replicas. They are picked in turn.
+type replicaPool struct {
+	clients []redis.Cmdable
+	next    uint32
+}
+
+// pick returns the next replica client.
+func (rp *replicaPool) pick() redis.Cmdable {
+	n := atomic.AddUint32(&rp.next, 1)
+	return rp.clients[int(n-1)%len(rp.clients)]
+}
+
+type primaryReadsKey struct{}
+
+// ReadFromPrimary returns a context that makes the handler read from the primary client rather than from replicas,
+// e.g. to read the items just written by the same client before they are replicated.
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// readsFromPrimary tells whether a context requires reads from the primary client.
+func readsFromPrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return primary
+}
+
+// read runs a read-only request with a replica client and falls back to the primary client if it fails.
+// The primary client is used at once if there are no replicas or the context requires so (see ReadFromPrimary).
+func (h *Handler) read(ctx context.Context, request func(c redis.Cmdable) error) error {
+	if h.replicas == nil || readsFromPrimary(ctx) {
+		return request(h.client)
+	}
+	err := request(h.replicas.pick())
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	return request(h.client)
+}
@@ -0,0 +1,52 @@
+package rds
+
+import (
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// maxCachedScripts is a limit of scripts kept by a scriptCache.
+// It protects the process from unbounded growth if queries of too many different shapes are issued.
+const maxCachedScripts = 1000
+
+// scriptCache keeps query scripts built by a Handler.
+// Query scripts are generated deterministically: values are passed as KEYS and ARGV, variables are named sequentially,
+// so the script source is defined only by the shape of a query (operators, fields types, sort, etc.)
+// and can be used as a cache key.
+// Scripts are run with EVALSHA, falling back to EVAL if Redis doesn't have them yet.
+type scriptCache struct {
+	mu      sync.RWMutex
+	scripts map[string]*redis.Script
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{
+		scripts: make(map[string]*redis.Script),
+	}
+}
+
+// get returns a cached script for the given source, creating it if needed.
+func (sc *scriptCache) get(src string) *redis.Script {
+	sc.mu.RLock()
+	s, ok := sc.scripts[src]
+	sc.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = redis.NewScript(src)
+	sc.mu.Lock()
+	if len(sc.scripts) < maxCachedScripts {
+		sc.scripts[src] = s
+	}
+	sc.mu.Unlock()
+	return s
+}
+
+// len returns a number of cached scripts.
+func (sc *scriptCache) len() int {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return len(sc.scripts)
+}
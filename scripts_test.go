@@ -0,0 +1,26 @@
+package rds
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptCache(t *testing.T) {
+	sc := newScriptCache()
+	s1 := sc.get("return 1")
+	s2 := sc.get("return 2")
+	assert.True(t, s1 == sc.get("return 1"))
+	assert.NotEqual(t, s1.Hash(), s2.Hash())
+	assert.Equal(t, 2, sc.len())
+}
+
+func TestScriptCache_Limit(t *testing.T) {
+	sc := newScriptCache()
+	for i := 0; i < maxCachedScripts+10; i++ {
+		s := sc.get(fmt.Sprintf("return %d", i))
+		assert.NotNil(t, s)
+	}
+	assert.Equal(t, maxCachedScripts, sc.len())
+}
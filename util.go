@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 	"math"
+	"strings"
 
 	"github.com/rs/rest-layer/schema/query"
 )
@@ -11,6 +12,9 @@ import (
 // Determine if value is numeric.
 // Numeric values are all ints, floats, time values.
 func isNumeric(v ...query.Value) bool {
+	if len(v) == 0 {
+		return false
+	}
 	switch v[0].(type) {
 	case int, int8, int16, int32, int64, float32, float64, time.Time:
 		return true
@@ -34,16 +38,20 @@ func valueToFloat(v query.Value) float64 {
 	return -1.0
 }
 
+// toFloat64 converts a value of any Go numeric type to float64. Returns NaN for non-numeric values.
 func toFloat64(in query.Value) float64 {
 	switch v := in.(type) {
 	case float64:
 		return v
 	case float32:
 		return float64(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return float64(toInt(v))
 	}
 	return math.NaN()
 }
 
+// toInt converts a value of any Go numeric type to int. Floats are truncated. Returns -1 for non-numeric values.
 // todo -1 ?
 func toInt(in query.Value) int {
 	switch v := in.(type) {
@@ -57,11 +65,43 @@ func toInt(in query.Value) int {
 		return int(v)
 	case int64:
 		return int(v)
+	case uint:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case uint64:
+		return int(v)
+	case float32:
+		return int(v)
+	case float64:
+		return int(v)
 	}
 	return -1
 }
 
-// todo - delete it?
+// toTime converts a value decoded by a codec to time.Time.
+// JSON keeps time as RFC3339 string, MessagePack decodes it as a pointer.
+func toTime(in interface{}) (time.Time, bool) {
+	switch v := in.(type) {
+	case time.Time:
+		return v, true
+	case *time.Time:
+		if v != nil {
+			return *v, true
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// inSlice checks if a string is present in a list
 func inSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -71,6 +111,42 @@ func inSlice(a string, list []string) bool {
 	return false
 }
 
+// payloadValue returns a value of a payload's field by its path, where names of nested fields are separated by dots.
+// Ex: payloadValue(payload, "meta.title")
+func payloadValue(payload map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = payload
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// isScalar checks if a value is neither an object nor an array
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	default:
+		return true
+	}
+}
+
+// hasValues checks if any of the values read from Redis is present
+func hasValues(values []interface{}) bool {
+	for _, v := range values {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func pr(v ...interface{}) {
 	for _, i := range v {
 		fmt.Printf("%#v\n", i)
@@ -33,6 +33,7 @@ func TestIsNumeric(t *testing.T) {
 	for i, tc := range cases {
 		assert.Equal(t, tc.want, isNumeric(tc.value), fmt.Sprintf("Test case #%d", i))
 	}
+	assert.False(t, isNumeric())
 }
 
 func TestInSlice(t *testing.T) {
@@ -52,3 +53,44 @@ func TestInSlice(t *testing.T) {
 		assert.Equal(t, tc.want, inSlice(tc.value, tc.data), fmt.Sprintf("Test case #%d", i))
 	}
 }
+
+func TestHasValues(t *testing.T) {
+	cases := []struct {
+		values []interface{}
+		want   bool
+	}{
+		{nil, false},
+		{[]interface{}{nil, nil}, false},
+		{[]interface{}{nil, "a"}, true},
+		{[]interface{}{""}, true},
+	}
+	for i, tc := range cases {
+		assert.Equal(t, tc.want, hasValues(tc.values), fmt.Sprintf("Test case #%d", i))
+	}
+}
+
+func TestPayloadValue(t *testing.T) {
+	payload := map[string]interface{}{
+		"name": "Bob",
+		"meta": map[string]interface{}{"title": "Hi", "stats": map[string]interface{}{"views": 5}},
+		"tags": []interface{}{"a"},
+	}
+	cases := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"name", "Bob", true},
+		{"meta.title", "Hi", true},
+		{"meta.stats.views", 5, true},
+		{"meta.body", nil, false},
+		{"name.first", nil, false},
+		{"tags.0", nil, false},
+		{"age", nil, false},
+	}
+	for i, tc := range cases {
+		value, found := payloadValue(payload, tc.path)
+		assert.Equal(t, tc.want, value, fmt.Sprintf("Test case #%d", i))
+		assert.Equal(t, tc.found, found, fmt.Sprintf("Test case #%d", i))
+	}
+}